@@ -0,0 +1,152 @@
+package mini_websocket
+
+import (
+	"bytes"
+	"testing"
+)
+
+// benchSizes 小帧和超过 shardSize 需要分片的大消息
+var benchSizes = []struct {
+	name string
+	n    int
+}{
+	{"small", 64},
+	{"large", 4 * shardSize},
+}
+
+var benchSides = []struct {
+	name     string
+	isServer bool
+}{
+	{"server", true},
+	{"client", false},
+}
+
+func BenchmarkAppendFrameHeader(b *testing.B) {
+	for _, sz := range benchSizes {
+		b.Run(sz.name, func(b *testing.B) {
+			frame := constructFrame(BinaryFrame, true, false)
+			frame.SetPayload(make([]byte, sz.n))
+			buf := make([]byte, 0, maxFrameHeaderByteSize)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf = appendFrameHeader(buf[:0], frame)
+			}
+		})
+	}
+}
+
+func BenchmarkSendFrame(b *testing.B) {
+	for _, sz := range benchSizes {
+		for _, side := range benchSides {
+			b.Run(sz.name+"/"+side.name, func(b *testing.B) {
+				wc := NewWsConn(&loopConn{data: []byte{0}}, side.isServer, 0, 0, 0)
+				frame := constructFrame(BinaryFrame, true, side.isServer)
+				frame.SetPayload(make([]byte, sz.n))
+				b.ReportAllocs()
+				b.SetBytes(int64(sz.n))
+				for i := 0; i < b.N; i++ {
+					if err := sendFrame(wc, frame); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkSendMessage(b *testing.B) {
+	for _, sz := range benchSizes {
+		for _, side := range benchSides {
+			b.Run(sz.name+"/"+side.name, func(b *testing.B) {
+				wc := NewWsConn(&loopConn{data: []byte{0}}, side.isServer, 0, 0, 0)
+				p := bytes.Repeat([]byte("a"), sz.n)
+				b.ReportAllocs()
+				b.SetBytes(int64(sz.n))
+				for i := 0; i < b.N; i++ {
+					if err := sendDataFrame(wc, p, BinaryFrame); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkNextWriter(b *testing.B) {
+	for _, sz := range benchSizes {
+		b.Run(sz.name, func(b *testing.B) {
+			wc := NewWsConn(&loopConn{data: []byte{0}}, true, 0, 0, 0)
+			p := bytes.Repeat([]byte("a"), sz.n)
+			b.ReportAllocs()
+			b.SetBytes(int64(sz.n))
+			for i := 0; i < b.N; i++ {
+				w, err := wc.NextWriter(BinaryFrame)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, _ = w.Write(p)
+				if err = w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	for _, sz := range benchSizes {
+		for _, side := range benchSides {
+			b.Run(sz.name+"/"+side.name, func(b *testing.B) {
+				//对端发来的帧：服务端读到的帧带掩码
+				frames := encodeMessageFrames(BinaryFrame, bytes.Repeat([]byte("a"), sz.n), 0, !side.isServer)
+				wc := NewWsConn(&loopConn{data: frames}, side.isServer, 0, 0, 0)
+				b.ReportAllocs()
+				b.SetBytes(int64(sz.n))
+				for i := 0; i < b.N; i++ {
+					_, p, err := wc.ReadMessage()
+					if err != nil || len(p) != sz.n {
+						b.Fatal(err, len(p))
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkNextReader(b *testing.B) {
+	for _, sz := range benchSizes {
+		b.Run(sz.name, func(b *testing.B) {
+			frames := encodeMessageFrames(BinaryFrame, bytes.Repeat([]byte("a"), sz.n), 0, false)
+			wc := NewWsConn(&loopConn{data: frames}, true, 0, 0, 0)
+			buf := make([]byte, 32<<10)
+			b.ReportAllocs()
+			b.SetBytes(int64(sz.n))
+			for i := 0; i < b.N; i++ {
+				_, r, err := wc.NextReader()
+				if err != nil {
+					b.Fatal(err)
+				}
+				for {
+					if _, err = r.Read(buf); err != nil {
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	for _, sz := range benchSizes {
+		b.Run(sz.name, func(b *testing.B) {
+			p := make([]byte, sz.n)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf := getBuffer()
+				buf.Write(p)
+				putBuffer(buf)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var errNotProtoMessage = errors.New("ProtoCodec 只能编解码实现了 ProtoMessage 的值")
+
+// Codec 消息的编解码器，一条消息对应一个值。Decode 从消息的读取流解码到v，不需要把整条消息读到内存里再转换；
+// Encode 先编码到缓冲区，编码成功后才发送，编码失败时不会发出任何帧
+type Codec interface {
+	// Name 编解码器的名字，如 "json"
+	Name() string
+	// MessageType 编码后发送的消息类型，TextFrame 或 BinaryFrame
+	MessageType() MessageType
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+// JSONCodec 基于 encoding/json 的编解码器，以text消息发送，是连接默认的编解码器
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) MessageType() MessageType {
+	return TextFrame
+}
+
+func (JSONCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (JSONCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+// ProtoMessage protobuf生成的消息类型（如 gogo/protobuf）都实现了该接口，
+// 官方 protobuf 的消息可以包装一层，调用 proto.Marshal 和 proto.Unmarshal 实现
+type ProtoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+// ProtoCodec 编解码实现了 ProtoMessage 的值，以binary消息发送。
+// protobuf的消息没有自描述的结束位置，解码时需要读出整条消息
+type ProtoCodec struct{}
+
+func (ProtoCodec) Name() string {
+	return "protobuf"
+}
+
+func (ProtoCodec) MessageType() MessageType {
+	return BinaryFrame
+}
+
+func (ProtoCodec) Encode(w io.Writer, v interface{}) error {
+	m, ok := v.(ProtoMessage)
+	if !ok {
+		return errNotProtoMessage
+	}
+	p, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(p)
+	return err
+}
+
+func (ProtoCodec) Decode(r io.Reader, v interface{}) error {
+	m, ok := v.(ProtoMessage)
+	if !ok {
+		return errNotProtoMessage
+	}
+	p, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return m.Unmarshal(p)
+}
+
+// NewMarshalCodec 用 Marshal/Unmarshal 风格的函数构造编解码器，如 MessagePack、CBOR 的第三方库：
+//
+//	NewMarshalCodec("msgpack", BinaryFrame, msgpack.Marshal, msgpack.Unmarshal)
+//	NewMarshalCodec("cbor", BinaryFrame, cbor.Marshal, cbor.Unmarshal)
+func NewMarshalCodec(name string, mt MessageType, marshal func(v interface{}) ([]byte, error), unmarshal func(data []byte, v interface{}) error) Codec {
+	return &marshalCodec{name: name, mt: mt, marshal: marshal, unmarshal: unmarshal}
+}
+
+type marshalCodec struct {
+	name      string
+	mt        MessageType
+	marshal   func(v interface{}) ([]byte, error)
+	unmarshal func(data []byte, v interface{}) error
+}
+
+func (mc *marshalCodec) Name() string {
+	return mc.name
+}
+
+func (mc *marshalCodec) MessageType() MessageType {
+	return mc.mt
+}
+
+func (mc *marshalCodec) Encode(w io.Writer, v interface{}) error {
+	p, err := mc.marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(p)
+	return err
+}
+
+func (mc *marshalCodec) Decode(r io.Reader, v interface{}) error {
+	p, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return mc.unmarshal(p, v)
+}
+
+// SetCodec 设置连接的编解码器，c为nil时使用 JSONCodec。
+// upGrader 和 Dialer 的 Codecs 会按协商的子协议自动设置
+func (wc *WsConn) SetCodec(c Codec) {
+	wc.codec = c
+}
+
+// Codec 连接当前使用的编解码器
+func (wc *WsConn) Codec() Codec {
+	if wc.codec == nil {
+		return JSONCodec{}
+	}
+	return wc.codec
+}
+
+// ReadValue 读取下一条消息并用连接的编解码器解码到v，消息中未被解码的部分会被丢弃
+func (wc *WsConn) ReadValue(v interface{}) error {
+	return wc.readWith(wc.Codec(), v)
+}
+
+// WriteValue 用连接的编解码器把v编码成一条消息发送
+func (wc *WsConn) WriteValue(v interface{}) error {
+	return wc.writeWith(wc.Codec(), v)
+}
+
+// ReadJSON 读取下一条消息并以JSON解码到v，不受连接的编解码器影响
+func (wc *WsConn) ReadJSON(v interface{}) error {
+	return wc.readWith(JSONCodec{}, v)
+}
+
+// WriteJSON 把v以JSON编码成一条text消息发送，不受连接的编解码器影响
+func (wc *WsConn) WriteJSON(v interface{}) error {
+	return wc.writeWith(JSONCodec{}, v)
+}
+
+func (wc *WsConn) readWith(c Codec, v interface{}) error {
+	_, r, err := wc.NextReader()
+	if err != nil {
+		return err
+	}
+
+	err = c.Decode(r, v)
+	if err == io.EOF {
+		//消息为空，或者消息在解码出完整的值之前就结束了
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (wc *WsConn) writeWith(c Codec, v interface{}) error {
+	//编码到共用的缓冲区，编码失败时连接上什么都没有发生
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := c.Encode(buf, v); err != nil {
+		return err
+	}
+
+	w, err := wc.NextWriter(c.MessageType())
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(buf.Bytes()); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
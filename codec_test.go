@@ -0,0 +1,71 @@
+package mini_websocket
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestWriteValueEncodeError 编码失败时不应向对端发出任何帧，连接可以继续使用
+func TestWriteValueEncodeError(t *testing.T) {
+	for _, level := range []int{NoCompression, BestSpeed} {
+		ug := NewUpGrader(0, 0, 0, nil, nil, level)
+		got := make(chan string, 2)
+		s := newTestServer(t, &ug, func(c *WsConn, r *http.Request) {
+			for {
+				_, p, err := c.ReadMessage()
+				if err != nil {
+					return
+				}
+				got <- string(p)
+			}
+		})
+		c := dialTest(t, s, &Dialer{CompressLevel: level})
+
+		if err := c.WriteJSON(make(chan int)); err == nil {
+			t.Fatal("WriteJSON(chan) succeeded")
+		}
+		if err := c.WriteValue(struct{ F func() }{}); err == nil {
+			t.Fatal("WriteValue(func) succeeded")
+		}
+		if err := c.WriteJSON("ok"); err != nil {
+			t.Fatal(err)
+		}
+		if p := <-got; p != "\"ok\"\n" {
+			t.Fatalf("level %d: first message = %q, want only the successful one", level, p)
+		}
+	}
+}
+
+type codecTestMsg struct {
+	Name string `json:"name"`
+	N    int    `json:"n"`
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	ug := NewUpGrader(0, 0, 0, nil, nil, 0)
+	ug.Subprotocols = []string{"json"}
+	ug.Codecs = map[string]Codec{"json": JSONCodec{}}
+	s := newTestServer(t, &ug, func(c *WsConn, r *http.Request) {
+		var m codecTestMsg
+		if err := c.ReadValue(&m); err != nil {
+			return
+		}
+		m.N++
+		_ = c.WriteValue(m)
+	})
+	c := dialTest(t, s, &Dialer{Subprotocols: []string{"json"}, Codecs: map[string]Codec{"json": JSONCodec{}}})
+
+	if err := c.WriteJSON(codecTestMsg{Name: "a", N: 1}); err != nil {
+		t.Fatal(err)
+	}
+	var m codecTestMsg
+	if err := c.ReadJSON(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m != (codecTestMsg{Name: "a", N: 2}) {
+		t.Fatalf("got %+v", m)
+	}
+	if _, ok := c.Codec().(JSONCodec); !ok {
+		t.Fatalf("codec = %T", c.Codec())
+	}
+}
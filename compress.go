@@ -0,0 +1,347 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	permessageDeflateName = "permessage-deflate"
+
+	maxDeflateWindowBits = 15
+	maxDeflateWindowSize = 1 << maxDeflateWindowBits //flate滑动窗口大小，32KB
+
+	deflateTail = "\x00\x00\xff\xff" //同步刷新的尾部四个字节，发送时去掉，接收时补上
+	deflateEnd  = "\x01\x00\x00\xff\xff"
+)
+
+var (
+	errDeflateNegotiate = errors.New("permessage-deflate协商参数不合法")
+	errDeflateRSV1      = errors.New("permessage-deflate只能在数据消息的第一个帧上设置rsv1")
+	errDeflateTail      = errors.New("permessage-deflate压缩数据的尾部不正确")
+)
+
+// PermessageDeflate RFC 7692 定义的 permessage-deflate 扩展，只压缩数据消息，
+// 压缩后的消息在第一个帧上设置 RSV1
+type PermessageDeflate struct {
+	//压缩等级
+	Level int
+	//要求服务端每条消息都重置压缩上下文；作为服务端时即使客户端没有请求也会响应该参数
+	ServerNoContextTakeover bool
+	//要求客户端每条消息都重置压缩上下文
+	ClientNoContextTakeover bool
+}
+
+// NewPermessageDeflate 压缩等级不合法时使用默认压缩等级
+func NewPermessageDeflate(level int) *PermessageDeflate {
+	if level < HuffmanOnly || level > BestCompression {
+		level = DefaultCompression
+	}
+	return &PermessageDeflate{Level: level}
+}
+
+func (p *PermessageDeflate) Name() string {
+	return permessageDeflateName
+}
+
+// Offer 不请求 client_max_window_bits，flate 只能使用32KB的窗口压缩
+func (p *PermessageDeflate) Offer() string {
+	var params []string
+	if p.ServerNoContextTakeover {
+		params = append(params, "server_no_context_takeover")
+	}
+	if p.ClientNoContextTakeover {
+		params = append(params, "client_no_context_takeover")
+	}
+	return strings.Join(params, "; ")
+}
+
+func (p *PermessageDeflate) Accept(params map[string]string) (ExtensionConn, string, bool) {
+	serverNoCtx, clientNoCtx := p.ServerNoContextTakeover, p.ClientNoContextTakeover
+	serverMaxWindowBits := false
+	for k, v := range params {
+		switch k {
+		case "server_no_context_takeover":
+			serverNoCtx = true
+		case "client_no_context_takeover":
+			clientNoCtx = true
+		case "server_max_window_bits":
+			//flate 只支持32KB的窗口，对端要求更小的窗口时拒绝该请求
+			if bits, err := strconv.Atoi(v); err != nil || bits != maxDeflateWindowBits {
+				return nil, "", false
+			}
+			serverMaxWindowBits = true
+		case "client_max_window_bits":
+			//解压时使用最大窗口，可以兼容客户端的任意窗口
+			if v != "" {
+				if bits, err := strconv.Atoi(v); err != nil || bits < 8 || bits > maxDeflateWindowBits {
+					return nil, "", false
+				}
+			}
+		default:
+			return nil, "", false
+		}
+	}
+
+	var resp []string
+	if serverNoCtx {
+		resp = append(resp, "server_no_context_takeover")
+	}
+	if clientNoCtx {
+		resp = append(resp, "client_no_context_takeover")
+	}
+	//请求中带了 server_max_window_bits 时响应必须带上该参数（RFC 7692 7.1.2.1）
+	if serverMaxWindowBits {
+		resp = append(resp, "server_max_window_bits="+strconv.Itoa(maxDeflateWindowBits))
+	}
+	return newDeflateConn(true, p.Level, serverNoCtx, clientNoCtx), strings.Join(resp, "; "), true
+}
+
+func (p *PermessageDeflate) Confirm(params map[string]string) (ExtensionConn, error) {
+	var serverNoCtx, clientNoCtx bool
+	for k, v := range params {
+		switch k {
+		case "server_no_context_takeover":
+			serverNoCtx = true
+		case "client_no_context_takeover":
+			clientNoCtx = true
+		case "server_max_window_bits":
+			if bits, err := strconv.Atoi(v); err != nil || bits < 8 || bits > maxDeflateWindowBits {
+				return nil, errDeflateNegotiate
+			}
+		default:
+			//未请求 client_max_window_bits，服务端不能响应该参数
+			return nil, errDeflateNegotiate
+		}
+	}
+	if p.ServerNoContextTakeover && !serverNoCtx {
+		return nil, errDeflateNegotiate
+	}
+
+	return newDeflateConn(false, p.Level, serverNoCtx, clientNoCtx), nil
+}
+
+// deflateConn 绑定在连接上的 permessage-deflate，保存压缩和解压的上下文
+type deflateConn struct {
+	isServer bool
+	level    int
+
+	serverNoContextTakeover bool //服务端每条消息都重置压缩上下文
+	clientNoContextTakeover bool //客户端每条消息都重置压缩上下文
+
+	fw *flate.Writer
+	sw switchWriter //fw 写入的目标，每条消息切换一次，避免重置压缩上下文
+
+	fr   io.ReadCloser
+	dict []byte //解压上下文：最近解压出的 maxDeflateWindowSize 字节
+}
+
+func newDeflateConn(isServer bool, level int, serverNoContextTakeover, clientNoContextTakeover bool) *deflateConn {
+	return &deflateConn{
+		isServer:                isServer,
+		level:                   level,
+		serverNoContextTakeover: serverNoContextTakeover,
+		clientNoContextTakeover: clientNoContextTakeover,
+	}
+}
+
+func (dc *deflateConn) RSV() uint16 {
+	return RSV1Bit
+}
+
+func (dc *deflateConn) OpCodes() []MessageType {
+	return nil
+}
+
+// usesDeflate 是否协商了 permessage-deflate
+func (wc *WsConn) usesDeflate() bool {
+	if wc.extensions == nil {
+		return false
+	}
+	for _, ec := range wc.extensions.conns {
+		if _, ok := ec.(*deflateConn); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNoContextTakeover 本端发送时是否每条消息都重置压缩上下文
+func (dc *deflateConn) writeNoContextTakeover() bool {
+	if dc.isServer {
+		return dc.serverNoContextTakeover
+	}
+	return dc.clientNoContextTakeover
+}
+
+// readNoContextTakeover 对端发送时是否每条消息都重置压缩上下文
+func (dc *deflateConn) readNoContextTakeover() bool {
+	if dc.isServer {
+		return dc.clientNoContextTakeover
+	}
+	return dc.serverNoContextTakeover
+}
+
+// WrapWriter 压缩 text、binary 消息，关闭时同步刷新并去掉尾部四个字节
+func (dc *deflateConn) WrapWriter(mt MessageType, w io.WriteCloser) (io.WriteCloser, uint16, error) {
+	if mt != TextFrame && mt != BinaryFrame {
+		return w, 0, nil
+	}
+
+	tw := &tailWriter{w: w}
+	dc.sw.w = tw
+	switch {
+	case dc.fw != nil && dc.writeNoContextTakeover():
+		dc.fw.Reset(&dc.sw)
+	case dc.fw != nil:
+	case dc.writeNoContextTakeover():
+		//不保留上下文时压缩器只在发送一条消息期间借用，连接不常驻压缩器
+		fw, err := getFlateWriter(&dc.sw, dc.level)
+		if err != nil {
+			return nil, 0, err
+		}
+		dc.fw = fw
+	default:
+		fw, err := flate.NewWriter(&dc.sw, dc.level)
+		if err != nil {
+			return nil, 0, err
+		}
+		dc.fw = fw
+	}
+
+	return &deflateWriter{dc: dc, tw: tw}, RSV1Bit, nil
+}
+
+// WrapReader 解压第一个帧设置了RSV1的消息
+func (dc *deflateConn) WrapReader(mt MessageType, rsv uint16, r io.Reader) (io.Reader, error) {
+	if rsv&RSV1Bit == 0 {
+		return r, nil
+	}
+
+	r = io.MultiReader(r, strings.NewReader(deflateTail+deflateEnd))
+
+	var dict []byte
+	if !dc.readNoContextTakeover() {
+		dict = dc.dict
+	}
+
+	if dc.fr == nil {
+		dc.fr = flate.NewReaderDict(r, dict)
+	} else if err := dc.fr.(flate.Resetter).Reset(r, dict); err != nil {
+		return nil, err
+	}
+
+	return &inflateReader{dc: dc}, nil
+}
+
+// compressNoContext 不使用压缩上下文压缩一条消息，并去掉同步刷新的尾部四个字节
+func compressNoContext(level int, p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := getFlateWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	defer putFlateWriter(fw, level)
+	if _, err = fw.Write(p); err != nil {
+		return nil, err
+	}
+	if err = fw.Flush(); err != nil {
+		return nil, err
+	}
+
+	b := buf.Bytes()
+	if !bytes.HasSuffix(b, []byte(deflateTail)) {
+		return nil, errDeflateTail
+	}
+	return b[:len(b)-len(deflateTail)], nil
+}
+
+// switchWriter 可切换目标的 io.Writer
+type switchWriter struct {
+	w io.Writer
+}
+
+func (sw *switchWriter) Write(p []byte) (int, error) {
+	return sw.w.Write(p)
+}
+
+// tailWriter 始终保留最后写入的四个字节不向下写，用于去掉同步刷新的尾部
+type tailWriter struct {
+	w    io.WriteCloser
+	tail [4]byte
+	n    int
+}
+
+func (tw *tailWriter) Write(p []byte) (int, error) {
+	written := len(p)
+
+	//缓存的尾部和p一共超过四个字节时，超出的部分向下写
+	if extra := tw.n + len(p) - len(tw.tail); extra > 0 {
+		if extra <= tw.n {
+			if _, err := tw.w.Write(tw.tail[:extra]); err != nil {
+				return 0, err
+			}
+			tw.n = copy(tw.tail[:], tw.tail[extra:tw.n])
+		} else {
+			if _, err := tw.w.Write(tw.tail[:tw.n]); err != nil {
+				return 0, err
+			}
+			if _, err := tw.w.Write(p[:extra-tw.n]); err != nil {
+				return 0, err
+			}
+			p = p[extra-tw.n:]
+			tw.n = 0
+		}
+	}
+
+	tw.n += copy(tw.tail[tw.n:], p)
+	return written, nil
+}
+
+type deflateWriter struct {
+	dc *deflateConn
+	tw *tailWriter
+}
+
+func (w *deflateWriter) Write(p []byte) (int, error) {
+	return w.dc.fw.Write(p)
+}
+
+func (w *deflateWriter) Close() error {
+	err := w.dc.fw.Flush()
+	if w.dc.writeNoContextTakeover() {
+		putFlateWriter(w.dc.fw, w.dc.level)
+		w.dc.fw = nil
+	}
+	if err != nil {
+		return err
+	}
+	if w.tw.n != len(w.tw.tail) || string(w.tw.tail[:]) != deflateTail {
+		return errDeflateTail
+	}
+	return w.tw.w.Close()
+}
+
+// inflateReader 解压的同时记录解压上下文
+type inflateReader struct {
+	dc *deflateConn
+}
+
+func (r *inflateReader) Read(p []byte) (int, error) {
+	n, err := r.dc.fr.Read(p)
+	if n > 0 && !r.dc.readNoContextTakeover() {
+		d := append(r.dc.dict, p[:n]...)
+		if len(d) > maxDeflateWindowSize {
+			d = d[:copy(d, d[len(d)-maxDeflateWindowSize:])]
+		}
+		r.dc.dict = d
+	}
+	return n, err
+}
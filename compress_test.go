@@ -0,0 +1,264 @@
+package mini_websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// TestDeflateRSV1OnlyOnFirstFrame RSV1 出现在延续帧或控制帧上时，按协议错误以1002关闭
+func TestDeflateRSV1OnlyOnFirstFrame(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+	}{
+		{"continuation", [][]byte{
+			rawFrame(TextFrame, false, 0, true, []byte("a")),
+			rawFrame(ContinuationFrame, true, RSV1Bit, true, []byte("b")),
+		}},
+		{"ping", [][]byte{rawFrame(PingFrame, true, RSV1Bit, true, []byte("p"))}},
+	}
+
+	ug := NewUpGrader(0, 0, 0, nil, nil, BestSpeed)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errc := make(chan error, 1)
+			s := newTestServer(t, &ug, func(c *WsConn, r *http.Request) {
+				_, _, err := c.ReadMessage()
+				errc <- err
+			})
+			c := dialTest(t, s, &Dialer{CompressLevel: BestSpeed})
+			if !c.usesDeflate() {
+				t.Fatal("permessage-deflate not negotiated")
+			}
+			for _, f := range tt.frames {
+				writeRaw(t, c, f)
+			}
+			if err := <-errc; !errors.Is(err, errDeflateRSV1) {
+				t.Fatalf("server err = %v, want %v", err, errDeflateRSV1)
+			}
+			expectCloseCode(t, c, CloseWrongProtocol)
+		})
+	}
+}
+
+// TestDeflateStreamsFrames permessage-deflate 不逐帧变换，数据帧不会被整个读进内存
+func TestDeflateStreamsFrames(t *testing.T) {
+	ug := NewUpGrader(0, 0, 0, nil, nil, BestSpeed)
+	ug.ReadLimit = 0
+	got := make(chan []byte, 1)
+	s := newTestServer(t, &ug, func(c *WsConn, r *http.Request) {
+		if c.hasFrameTransformer() {
+			t.Error("deflate connection buffers whole frames")
+		}
+		_, p, err := c.ReadMessage()
+		if err != nil {
+			t.Error(err)
+		}
+		got <- p
+	})
+	c := dialTest(t, s, &Dialer{CompressLevel: BestSpeed})
+	if c.hasFrameTransformer() {
+		t.Fatal("deflate connection buffers whole frames")
+	}
+
+	msg := bytes.Repeat([]byte("stream me "), 3*shardSize)
+	if err := c.SendMessage(string(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-got; !bytes.Equal(p, msg) {
+		t.Fatalf("got %d bytes, want %d", len(p), len(msg))
+	}
+}
+
+// countConn 统计读写的字节数
+type countConn struct {
+	net.Conn
+	r, w int64
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.r, int64(n))
+	return n, err
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(&c.w, int64(len(p)))
+	return c.Conn.Write(p)
+}
+
+// incompressible 不能自我压缩的消息，只有接管上下文时重复发送才能变小
+func incompressible(n int) []byte {
+	p := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(p)
+	return p
+}
+
+// TestDeflateRoundTrip 按协商的上下文接管参数压缩和解压，同样的消息再次发送时，接管上下文的一端只发送很少的字节
+func TestDeflateRoundTrip(t *testing.T) {
+	tests := []struct {
+		name                  string
+		serverNoCtx, cliNoCtx bool
+		serverTakeover        bool //服务端开启 CompressContextTakeover
+	}{
+		{"context takeover", false, false, true},
+		{"server no context takeover", true, false, true},
+		{"client no context takeover", false, true, true},
+		{"no context takeover", true, true, true},
+		{"server default", false, false, false},
+	}
+
+	msg := incompressible(4096)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ug := NewUpGrader(0, 0, 0, nil, nil, BestSpeed)
+			ug.CompressContextTakeover = tt.serverTakeover
+			s := newTestServer(t, &ug, func(c *WsConn, r *http.Request) {
+				for {
+					mt, p, err := c.ReadMessage()
+					if err != nil {
+						return
+					}
+					if err = sendDataFrame(c, p, mt); err != nil {
+						return
+					}
+				}
+			})
+
+			var cc *countConn
+			d := &Dialer{
+				Extensions: []Extension{&PermessageDeflate{
+					Level:                   BestSpeed,
+					ServerNoContextTakeover: tt.serverNoCtx,
+					ClientNoContextTakeover: tt.cliNoCtx,
+				}},
+				NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					nc, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+					cc = &countConn{Conn: nc}
+					return cc, err
+				},
+			}
+			c := dialTest(t, s, d)
+			if !c.usesDeflate() {
+				t.Fatal("permessage-deflate not negotiated")
+			}
+
+			//服务端的回复在客户端读完之前不会再有别的数据，读到的字节数就是服务端发送的字节数
+			var clientSent, serverSent []int64
+			for i := 0; i < 3; i++ {
+				w, r := atomic.LoadInt64(&cc.w), atomic.LoadInt64(&cc.r)
+				if err := sendDataFrame(c, msg, BinaryFrame); err != nil {
+					t.Fatal(err)
+				}
+				_, p, err := c.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(p, msg) {
+					t.Fatalf("message %d differs after round trip", i)
+				}
+				clientSent = append(clientSent, atomic.LoadInt64(&cc.w)-w)
+				serverSent = append(serverSent, atomic.LoadInt64(&cc.r)-r)
+			}
+
+			checkTakeover(t, "client", clientSent, !tt.cliNoCtx)
+			checkTakeover(t, "server", serverSent, tt.serverTakeover && !tt.serverNoCtx)
+		})
+	}
+}
+
+// checkTakeover 接管上下文时重复的消息应远小于第一次发送，否则每次发送的大小相同
+func checkTakeover(t *testing.T, side string, sent []int64, takeover bool) {
+	t.Helper()
+	for i := 1; i < len(sent); i++ {
+		if takeover && sent[i] >= sent[0]/4 {
+			t.Fatalf("%s sent %v bytes, repeated messages did not use the context", side, sent)
+		}
+		if !takeover && sent[i] != sent[0] {
+			t.Fatalf("%s sent %v bytes, repeated messages used the context", side, sent)
+		}
+	}
+}
+
+// TestUpGradeDeflateContextTakeover 服务端默认响应 server_no_context_takeover，连接不常驻压缩器，
+// 预编码的消息可以复用；开启 CompressContextTakeover 后保留压缩上下文
+func TestUpGradeDeflateContextTakeover(t *testing.T) {
+	tests := []struct {
+		name     string
+		takeover bool
+		resp     string
+	}{
+		{"default", false, "permessage-deflate; server_no_context_takeover"},
+		{"opt in", true, "permessage-deflate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ug := NewUpGrader(0, 0, 0, nil, nil, BestSpeed)
+			ug.CompressContextTakeover = tt.takeover
+
+			//浏览器只请求 permessage-deflate; client_max_window_bits
+			h := http.Header{"Sec-Websocket-Extensions": {"permessage-deflate; client_max_window_bits"}}
+			if _, resp := acceptExtensions(parseExtensions(h), ug.extensions()); resp != tt.resp {
+				t.Fatalf("resp = %q, want %q", resp, tt.resp)
+			}
+
+			errc := make(chan error, 1)
+			s := newTestServer(t, &ug, func(c *WsConn, r *http.Request) {
+				errc <- func() error {
+					if err := c.SendMessage("hello hello hello"); err != nil {
+						return err
+					}
+					for _, ec := range c.extensions.conns {
+						if dc, ok := ec.(*deflateConn); ok && (dc.fw != nil) != tt.takeover {
+							return fmt.Errorf("compressor kept = %v", dc.fw != nil)
+						}
+					}
+					if _, ok := c.preparedKey(); ok == tt.takeover {
+						return fmt.Errorf("prepared message reusable = %v", ok)
+					}
+					return nil
+				}()
+			})
+			c := dialTest(t, s, &Dialer{CompressLevel: BestSpeed})
+			if _, p, err := c.ReadMessage(); err != nil || string(p) != "hello hello hello" {
+				t.Fatalf("got %q, %v", p, err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestAcceptPermessageDeflate(t *testing.T) {
+	tests := []struct {
+		offer string
+		resp  string
+	}{
+		{"permessage-deflate", "permessage-deflate"},
+		{"permessage-deflate; client_max_window_bits", "permessage-deflate"},
+		{"permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+			"permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		{"permessage-deflate; server_max_window_bits=15", "permessage-deflate; server_max_window_bits=15"},
+		{"permessage-deflate; client_no_context_takeover; server_max_window_bits=15",
+			"permessage-deflate; client_no_context_takeover; server_max_window_bits=15"},
+		{"permessage-deflate; server_max_window_bits=10, permessage-deflate", "permessage-deflate"},
+		{"permessage-deflate; server_max_window_bits=10", ""},
+		{"permessage-deflate; unknown", ""},
+		{"x-webkit-deflate-frame", ""},
+	}
+	for _, tt := range tests {
+		h := http.Header{"Sec-Websocket-Extensions": {tt.offer}}
+		_, resp := acceptExtensions(parseExtensions(h), []Extension{NewPermessageDeflate(BestSpeed)})
+		if resp != tt.resp {
+			t.Errorf("%q: resp = %q, want %q", tt.offer, resp, tt.resp)
+		}
+	}
+}
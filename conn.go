@@ -10,52 +10,124 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 const (
 	SendCriticalSize = 1024 * 1000 * 2 //发送数据大小限制，避免恶意数据
 	shardSize        = 65535           //分片大小
 
-	minReadBufferSize  = 65535 //网络连接缓冲区的读的最少字节数
-	minWriteBufferSize = 65535 //网络连接缓冲区的读的少字节数
+	defaultReadBufferSize  = 65535 //网络连接缓冲区的读的默认字节数
+	defaultWriteBufferSize = 65535 //网络连接缓冲区的写的默认字节数
+
+	minReadBufferSize  = 256 //网络连接缓冲区的读的最少字节数
+	minWriteBufferSize = 256 //网络连接缓冲区的写的最少字节数
 
 	maxReadBufferSize  = 65535 * 10 //网络连接缓冲区的读的最多字节数
 	maxWriteBufferSize = 65535 * 10 //网络连接缓冲区的写的最多字节数
+
+	closeHandshakeTimeout = 3 * time.Second //发起关闭后等待对端关闭帧的最长时间
+
+	defaultReadLimit = SendCriticalSize //upGrader 默认的单条消息读取限制
 )
 
-// WsConn websocket连接
+// WsConn websocket连接，发送方法可以被多个goroutine并发调用，
+// 读取方法同一时刻只能有一个goroutine调用
 type WsConn struct {
+	lastPong int64 //最近一次收到pong帧的时间，原子访问，放在第一个字段保证32位平台上的8字节对齐
+
 	Conn  net.Conn
-	BufRD *bufio.Reader // 读，缓冲区的数据
-	BufWR *bufio.Writer // 写，缓冲区的数据
+	BufRD *bufio.Reader // 读，缓冲区的数据，服务端在第一次读取时才分配
+	BufWR *bufio.Writer // 写，缓冲区的数据，第一次发送时才分配；使用写缓冲池时一直为nil
+
+	readBufferSize  int        //读缓冲区的字节数
+	writeBufferSize int        //写缓冲区的字节数
+	writePool       BufferPool //写缓冲池，不为nil时每次发送从池里借用写缓冲区
 
 	IsServer      bool //标记服务端，服务端向客户端发送帧数据时，不需要掩码处理
 	CompressLevel int  //压缩等级
+
+	extensions  *extensionSet //握手时协商的扩展，为nil表示没有扩展
+	subprotocol string        //握手时协商的子协议
+	codec       Codec         //ReadValue 和 WriteValue 使用的编解码器，为nil时使用 JSONCodec
+
+	writeMu   sync.Mutex                   //保证每个帧完整地写入 BufWR，读协程回复的控制帧也要获取该锁
+	msgMu     sync.Mutex                   //保证一条数据消息的分片连续发送，不与其他数据消息交错
+	headerBuf [maxFrameHeaderByteSize]byte //序列化帧头部的缓冲区，受 writeMu 保护
+
+	logger connLogger //连接的日志，默认不输出
+
+	poll *pollConn //已加入 EventLoop，读写缓冲区只在处理时借用
+
+	pingHandler func(appData []byte) error //收到ping帧时调用
+	pongHandler func(appData []byte) error //收到pong帧时调用
+	deadErr     atomic.Value               //保活判定连接断开时的 *CloseError
+
+	reader    io.Reader //NextReader 返回的当前消息，读取下一条消息前需要读完
+	readLimit int64     //单条消息的最大字节数，为0时不限制
+
+	closeSent    bool          //已发送关闭帧，受 writeMu 保护
+	closeRecv    chan struct{} //收到对端的关闭帧时通知发起关闭的一方
+	closeOnce    sync.Once
+	closeErr     *CloseError //对端关闭帧携带的状态码和原因
+	tcpCloseOnce sync.Once
+	hookMu       sync.Mutex
+	tcpClosed    bool     //底层tcp连接已关闭，受 hookMu 保护
+	closeHooks   []func() //关闭底层tcp连接后调用，受 hookMu 保护
+
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time //调用方设置的读超时时间，ctx中断读取后用于恢复
+	writeDeadline time.Time //调用方设置的写超时时间，ctx中断写入后用于恢复
 }
 
-// NewWsConn 构造websocket.Conn
-func NewWsConn(netConn net.Conn, isServer bool, ReadBufferSize, WriteBufferSize int, compressLevel int) *WsConn {
-	if ReadBufferSize < minReadBufferSize || ReadBufferSize > maxReadBufferSize {
-		ReadBufferSize = minReadBufferSize
-	}
+// BufferPool 写缓冲区池，*sync.Pool 实现了该接口。连接只在发送时从池里借用写缓冲区，
+// 大量连接共用少量缓冲区；同一个池应搭配相同的 WriteBufferSize 使用
+type BufferPool interface {
+	Get() interface{}
+	Put(interface{})
+}
 
-	if WriteBufferSize < minWriteBufferSize || WriteBufferSize > maxWriteBufferSize {
-		WriteBufferSize = minWriteBufferSize
-	}
+// NewWsConn 构造websocket.Conn，缓冲区大小为0时使用默认的65535字节，超出范围时取最近的边界值
+func NewWsConn(netConn net.Conn, isServer bool, ReadBufferSize, WriteBufferSize int, compressLevel int) *WsConn {
+	ReadBufferSize = bufferSize(ReadBufferSize, defaultReadBufferSize, minReadBufferSize, maxReadBufferSize)
+	return newWsConn(netConn, isServer, bufio.NewReaderSize(netConn, ReadBufferSize), ReadBufferSize, WriteBufferSize, compressLevel)
+}
 
+// newWsConn br为nil时在第一次读取时分配读缓冲区，写缓冲区都在第一次发送时分配
+func newWsConn(netConn net.Conn, isServer bool, br *bufio.Reader, readBufferSize, writeBufferSize int, compressLevel int) *WsConn {
 	c := &WsConn{
-		Conn:          netConn,
-		IsServer:      isServer,
-		BufRD:         bufio.NewReaderSize(netConn, ReadBufferSize),
-		BufWR:         bufio.NewWriterSize(netConn, WriteBufferSize),
-		CompressLevel: compressLevel,
+		Conn:            netConn,
+		IsServer:        isServer,
+		BufRD:           br,
+		readBufferSize:  bufferSize(readBufferSize, defaultReadBufferSize, minReadBufferSize, maxReadBufferSize),
+		writeBufferSize: bufferSize(writeBufferSize, defaultWriteBufferSize, minWriteBufferSize, maxWriteBufferSize),
+		CompressLevel:   compressLevel,
+		closeRecv:       make(chan struct{}, 1),
+		logger:          newConnLogger(),
 	}
+	c.SetPingHandler(nil)
+	c.SetPongHandler(nil)
 
 	return c
 }
 
+// bufferSize 校正缓冲区大小，为0时使用默认值
+func bufferSize(size, def, min, max int) int {
+	switch {
+	case size <= 0:
+		return def
+	case size < min:
+		return min
+	case size > max:
+		return max
+	}
+	return size
+}
+
 func (wc *WsConn) LocalAddr() net.Addr {
 	return wc.Conn.LocalAddr()
 }
@@ -64,39 +136,38 @@ func (wc *WsConn) RemoteAddr() net.Addr {
 	return wc.Conn.RemoteAddr()
 }
 
-// ReadMessage 读取text、binary、延续帧
+// SetReadLimit 设置单条消息的最大字节数，limit<=0 时不限制。
+// 收到的消息超过限制时，以 CloseTooBigData 关闭连接，读取返回 ErrReadLimit
+func (wc *WsConn) SetReadLimit(limit int64) {
+	if limit < 0 {
+		limit = 0
+	}
+	wc.readLimit = limit
+}
+
+// Subprotocol 握手时协商的子协议，没有协商时为空串
+func (wc *WsConn) Subprotocol() string {
+	return wc.subprotocol
+}
+
+// ReadMessage 读取text、binary、延续帧，将一条消息的所有分片组装到一起
 func (wc *WsConn) ReadMessage() (mt MessageType, msg []byte, err error) {
-	frame, err := readFrame(wc)
+	mt, r, err := wc.NextReader()
 	if err != nil {
-		log.Printf("Conn.ReadMessage failed to c.readFrame, err=%v\n", err)
+		wc.logger.debug("Conn.ReadMessage failed to c.NextReader", "err", err)
 		return NoFrame, nil, err
 	}
-	mt = MessageType(frame.OpCode)
-
-	frame.MaskPayload()
-	log.Println("frame decode mask payload: ", string(frame.Payload))
-
-	// 根据读到的帧判断是否还有后续的帧，如果有分片，那就读完将payload组装到一起
-	buf := bytes.NewBuffer(nil)
-	buf.Write(frame.Payload)
 
-	for !frame.IsFinal() {
-		if frame, err = readFrame(wc); err != nil {
-			log.Printf("Conn.ReadMessage failed to c.readFrame, err=%v", err)
-			return NoFrame, nil, err
-		}
-
-		frame.MaskPayload()
-		log.Println("frame decode mask payload: ", string(frame.Payload))
-		// todo
-		//zipBytes := tool.UGZipBytes(frame.Payload)
-		//log.Println(len(zipBytes), zipBytes)
-
-		//buf.Write(zipBytes)
-		buf.Write(frame.Payload)
+	//在共用的缓冲区里组装消息，只为返回的消息分配一次内存
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err = buf.ReadFrom(r); err != nil {
+		wc.logger.debug("Conn.ReadMessage failed to read message", "err", err)
+		return NoFrame, nil, err
 	}
+	msg = append(make([]byte, 0, buf.Len()), buf.Bytes()...)
+	wc.logger.debug("Conn.ReadMessage got message", "type", mt, "payload", wc.logger.payload(msg))
 
-	msg = buf.Bytes()
 	return
 }
 
@@ -105,26 +176,28 @@ func read(wc *WsConn, n int) ([]byte, error) {
 	//谨慎探测
 	p, err := wc.BufRD.Peek(n)
 	if err == io.EOF {
-		return nil, err
+		return nil, wc.readErr(err)
 	}
 	//探测没问题
 	_, _ = wc.BufRD.Discard(len(p))
-	return p, err
+	return p, wc.readErr(err)
 }
 
-// readFrame 从字节流里读出一个完整帧的数据，由于控制帧只能是一个帧，所以在读取帧的时候应当处理完控制帧
-func readFrame(wc *WsConn) (*Frame, error) {
+// readFrameHeader 从字节流里读出帧的头部并校验，返回负载的字节数，负载留在缓冲区里
+func readFrameHeader(wc *WsConn) (*Frame, uint64, error) {
 	//1000 0001 1000 1011
 	// 读2Byte的数据，取出字节流的帧头部
 	p, err := read(wc, 2)
 	if err != nil {
-		log.Printf("Conn.readFrame failed to c.read(header), err=%v", err)
-		return nil, err
+		wc.logger.debug("Conn.readFrame failed to c.read(header)", "err", err)
+		//未收到关闭帧连接就断开了
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = &CloseError{Code: CloseAbnormal, Reason: err.Error()}
+		}
+		return nil, 0, err
 	}
-	log.Println("Conn.readFrame got frameWithoutPayload bytes: ", p)
 	// 解析WebSocket帧头部
 	frameWithoutPayload := ParseToFrameHeader(p)
-	log.Printf("Conn.readFrame got frameWithoutPayload=%+v", frameWithoutPayload)
 
 	remainBytesNum := uint64(frameWithoutPayload.PayloadLen) //payload的字节数，默认等于PayloadLen
 
@@ -134,8 +207,8 @@ func readFrame(wc *WsConn) (*Frame, error) {
 	case 126:
 		//再从p中取出2个字节
 		if p, err = read(wc, 2); err != nil {
-			log.Printf("Conn.readFrame failed to c.read(2) payloadlen with 16bit, err=%v", err)
-			return nil, err
+			wc.logger.debug("Conn.readFrame failed to c.read(2) payloadlen with 16bit", "err", err)
+			return nil, 0, err
 		}
 		payloadExtLen16 := binary.BigEndian.Uint16(p[:2])
 		frameWithoutPayload.PayloadExtendLen16 = payloadExtLen16
@@ -144,8 +217,8 @@ func readFrame(wc *WsConn) (*Frame, error) {
 	case 127:
 		// 再从p中取出8个字节
 		if p, err = read(wc, 8); err != nil {
-			log.Printf("Conn.readFrame failed to c.read(8) payloadlen with 16bit, err=%v", err)
-			return nil, err
+			wc.logger.debug("Conn.readFrame failed to c.read(8) payloadlen with 64bit", "err", err)
+			return nil, 0, err
 		}
 		payloadExtLen64 := binary.BigEndian.Uint64(p[:8])
 		frameWithoutPayload.PayloadExtendLen64 = payloadExtLen64
@@ -155,66 +228,126 @@ func readFrame(wc *WsConn) (*Frame, error) {
 	if frameWithoutPayload.Mask == 1 {
 		// 再从字节流里读出4个字节的maskingKey
 		if p, err = read(wc, 4); err != nil {
-			log.Printf("Conn.readFrame failed to c.read(header), err=%v", err)
-			return nil, err
+			wc.logger.debug("Conn.readFrame failed to c.read(maskingKey)", "err", err)
+			return nil, 0, err
 		}
 		frameWithoutPayload.MaskingKey = binary.BigEndian.Uint32(p)
 	}
 
 	// frame校验，先校验非负载数据
-	if err = CheckFrameWithoutPayload(frameWithoutPayload); err != nil {
-		log.Printf("Conn.readFrame failed to c.read(header), err=%v", err)
+	if err = CheckFrameWithoutPayload(frameWithoutPayload); err == nil {
+		err = checkReadFrame(wc, frameWithoutPayload)
+	}
+	if err != nil {
+		wc.logger.warn("Conn.readFrame got invalid frame header", "frame", frameWithoutPayload, "err", err)
 		if err := wc.CloseWrongProtocol(); err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		return nil, err
+		return nil, 0, err
 	}
+	wc.logger.debug("Conn.readFrame got frame header", "frame", frameWithoutPayload)
 
-	// 读取payload数据并填充到frame中去
-	payload := make([]byte, 0, remainBytesNum)
-	log.Printf("Conn.readFrame c.read(%d) into payload data", remainBytesNum)
+	return frameWithoutPayload, remainBytesNum, nil
+}
+
+// checkReadFrame 校验读到的帧是否符合本端的协议要求
+func checkReadFrame(wc *WsConn, frame *Frame) error {
+	opcode := MessageType(frame.OpCode)
+	switch {
+	case frame.RSV()&^wc.negotiatedRSV() != 0:
+		//未协商的rsv位不能使用
+		return errFrameRSVNotAccept
+	case frame.RSV1 == 1 && opcode != TextFrame && opcode != BinaryFrame && wc.usesDeflate():
+		//permessage-deflate 只能在数据消息的第一个帧上设置RSV1，控制帧和延续帧都不能设置
+		return errDeflateRSV1
+	case isReservedOpCode(opcode) && !wc.claimedOpCode(opcode):
+		//未被扩展占用的保留opcode
+		return errFrameOpCodeNotAccept
+	case wc.IsServer && frame.Mask == 0:
+		//客户端发送的帧必须掩码
+		return ErrFrameNotMasked
+	case !wc.IsServer && frame.Mask == 1:
+		//服务端发送的帧不能掩码
+		return ErrFrameMasked
+	}
+	return nil
+}
 
-	// WsConn.Read 能接受的类型是 int 不能读取太大的数据，避免大类型强转小类型数据丢失
-	// -> uint64 > int(64位os里是有符号)；因此需要分片读取
-	for remainBytesNum > shardSize {
-		//数据可能变小了: wc.Read(int(remainBytesNum))
-		p, err := read(wc, shardSize)
-		if err != nil {
-			log.Printf("Conn.readFrame failed to c.read(payload), err=%v", err)
+// checkReadLimit 读出负载前，按帧头部声明的长度校验消息是否超过读取限制，
+// received为同一条消息已经收到的字节数
+func checkReadLimit(wc *WsConn, received, remainBytesNum uint64) error {
+	if wc.readLimit <= 0 {
+		return nil
+	}
+	if received > uint64(wc.readLimit) || remainBytesNum > uint64(wc.readLimit)-received {
+		wc.logger.warn("Conn.readFrame message exceeds read limit", "limit", wc.readLimit)
+		_ = wc.CloseTooBigData()
+		return ErrReadLimit
+	}
+	return nil
+}
+
+// readPayload 从缓冲区读出n个字节的负载
+func readPayload(wc *WsConn, remainBytesNum uint64) ([]byte, error) {
+	//头部声明的长度不可信，按实际读到的数据扩容
+	size := remainBytesNum
+	if size > shardSize {
+		size = shardSize
+	}
+	payload := bytes.NewBuffer(make([]byte, 0, size))
+	wc.logger.debug("Conn.readFrame c.read into payload data", "len", remainBytesNum)
+
+	// uint64 的长度不能直接转成有符号数，需要分片读取；
+	// 从缓冲区拷贝而不是探测，读缓冲区可以小于分片
+	for remainBytesNum > 0 {
+		n := remainBytesNum
+		if n > shardSize {
+			n = shardSize
+		}
+		if _, err := io.CopyN(payload, wc.BufRD, int64(n)); err != nil {
+			err = wc.readErr(err)
+			wc.logger.debug("Conn.readFrame failed to c.read(payload)", "err", err)
 			return nil, err
 		}
-		payload = append(payload, p...)
-		remainBytesNum -= shardSize
+		remainBytesNum -= n
 	}
 
-	// 读取剩余部分的payload
-	p, err = read(wc, int(remainBytesNum))
-	if err != nil {
-		log.Printf("Conn.readFrame failed to c.read(payload), err=%v", err)
-		return nil, err
-	}
+	return payload.Bytes(), nil
+}
 
-	payload = append(payload, p...)
+// handleFrame 去掉读到的完整帧的掩码，交给扩展变换，并处理控制帧
+func handleFrame(wc *WsConn, frame *Frame) (err error) {
+	//去掉掩码，后续处理的都是原始数据
+	frame.MaskPayload()
 
-	frameWithoutPayload.Payload = payload
+	//交给扩展变换
+	if err = wc.readFrameExtensions(frame); err != nil {
+		wc.logger.warn("Conn.readFrame failed to c.readFrameExtensions", "err", err)
+		if err := wc.CloseWrongProtocol(); err != nil {
+			return err
+		}
+		return err
+	}
 
-	// 只处理ping pong close 帧
-	switch MessageType(frameWithoutPayload.OpCode) {
+	// 只处理ping pong close 帧，扩展占用的保留opcode交给调用方处理
+	switch MessageType(frame.OpCode) {
 	case TextFrame, BinaryFrame, ContinuationFrame:
 		//不处理可能有连续帧的类型
 	case PingFrame:
-		err = wc.ReplyPing(frameWithoutPayload)
+		err = wc.pingHandler(frame.Payload)
 	case PongFrame:
-		err = wc.ReplyPong()
+		atomic.StoreInt64(&wc.lastPong, time.Now().UnixNano())
+		err = wc.pongHandler(frame.Payload)
 	case ConnectionCloseFrame:
-		//解析帧中收到关闭帧时，正常关闭
-		err = wc.CloseRight()
-	default:
-		//不能接受的类型 TODO: 扩展协议接受类型
-		err = wc.CloseNotAccept()
+		//解析关闭帧，完成关闭握手
+		return handleClose(wc, frame)
 	}
 
-	return frameWithoutPayload, err
+	//已经发起关闭时不再回复ping、pong，继续等待对端的关闭帧
+	if err == ErrCloseSent {
+		err = nil
+	}
+	return err
 }
 
 func (wc *WsConn) Ping() (err error) {
@@ -231,21 +364,14 @@ func (wc *WsConn) Pong(pingPayload []byte) (err error) {
 }
 
 // ReplyPong 响应pong帧
+//
+// Deprecated: 收到pong帧时不再自动回复ping帧，避免两端不停地互相发送；需要时使用 SetPongHandler
 func (wc *WsConn) ReplyPong() (err error) {
 	return wc.Ping()
 }
 
 // SendMessage 发送text数据
 func (wc *WsConn) SendMessage(text string) (err error) {
-	//zipBytes, err := tool.GZipBytes([]byte(text), wc.CompressLevel)
-	//if err != nil {
-	//	if err := wc.CloseInternalError(); err != nil {
-	//		return err
-	//	}
-	//	return err
-	//}
-	//fmt.Println(len(zipBytes), zipBytes)
-	// todo
 	return sendDataFrame(wc, []byte(text), TextFrame)
 }
 
@@ -253,122 +379,232 @@ func (wc *WsConn) SendMessage(text string) (err error) {
 func (wc *WsConn) SendBinary(r io.Reader) (err error) {
 	payload, err := ioutil.ReadAll(r)
 	if err != nil {
-		log.Printf("c.SendBinary failed to ioutil.ReadAll, err=%v", err)
+		wc.logger.debug("c.SendBinary failed to ioutil.ReadAll", "err", err)
 		return err
 	}
 
 	return sendDataFrame(wc, payload, BinaryFrame)
 }
 
-// sendDataFrame 发送数据帧：opcode应限制为text和binary
+// SendExtMessage 发送扩展占用的保留opcode的消息
+func (wc *WsConn) SendExtMessage(opcode MessageType, payload []byte) (err error) {
+	if !wc.claimedOpCode(opcode) {
+		return fmt.Errorf("opcode=%d is not claimed by any extension", opcode)
+	}
+	if isControlOpCode(opcode) {
+		return sendControlFrame(wc, opcode, payload)
+	}
+	return sendDataFrame(wc, payload, opcode)
+}
+
+// sendDataFrame 发送数据帧：opcode应限制为text、binary和扩展占用的非控制帧opcode
 func sendDataFrame(wc *WsConn, data []byte, opcode MessageType) (err error) {
 	switch opcode {
 	case TextFrame, BinaryFrame:
 	default:
-		return fmt.Errorf("invalid opcode=%d for data frame", opcode)
+		if isControlOpCode(opcode) || !wc.claimedOpCode(opcode) {
+			return fmt.Errorf("invalid opcode=%d for data frame", opcode)
+		}
 	}
 
-	log.Printf("data frame...")
+	wc.logger.debug("c.send data frame", "type", opcode, "payload", wc.logger.payload(data))
 
 	if len(data) > SendCriticalSize {
 		return wc.CloseTooBigData()
 	}
 
-	//分片传输
-	if len(data) > shardSize {
-		frames := fragmentDataFrames(data, wc.IsServer, opcode)
-		for _, frame := range frames {
-			if err = sendFrame(wc, frame); err != nil {
-				log.Printf("c.send failed to c.sendFrame err=%v", err)
-				return
-			}
-		}
-		return
-	}
+	//整条消息的编码和所有分片都在 WsConn.msgMu 的保护下完成，分片之间只可能插入控制帧
+	wc.msgMu.Lock()
+	defer wc.msgMu.Unlock()
 
-	//未分片传输
-	frame := constructDataFrame(data, wc.IsServer, opcode)
-	if err = sendFrame(wc, frame); err != nil {
-		log.Printf("c.send failed to c.sendFrame err=%v", err)
-		return
+	//交给扩展编码整条消息，并在第一个帧上设置扩展要求的rsv位
+	data, rsv, buf, err := encodeMessage(wc, opcode, data)
+	if err != nil {
+		wc.logger.error("c.send failed to encodeMessage", "err", err)
+		return err
 	}
+	//帧都写入 WsConn.BufWR 之后才能放回缓冲区
+	defer putBuffer(buf)
 
-	return
+	//超过 shardSize 时分片传输，第一个帧的opcode设置为0x1或0x2，其余为延续帧
+	return shardFrames(opcode, data, rsv, wc.IsServer, func(frame *Frame) error {
+		if err := sendFrame(wc, frame); err != nil {
+			wc.logger.debug("c.send failed to c.sendFrame", "err", err)
+			return err
+		}
+		return nil
+	})
 }
 
-// fragmentDataFrames 将大片数据拆分成若干 shardSize 大小的数据
-func fragmentDataFrames(data []byte, noMask bool, opcode MessageType) []*Frame {
-	s := len(data)
-	start, end, n := 0, 0, s/shardSize
-
-	frames := make([]*Frame, 0, n+1)
-
-	//将大数据分成 s / shardSize 份，每份 shardSize
-	for i := 1; i <= n; i++ {
-		start, end = (i-1)*shardSize, i*shardSize
-		frames = append(frames, constructDataFrame(data[start:end], noMask, ContinuationFrame))
+// encodeMessage 依次交给扩展编码消息负载。编码后的负载在从 bufferPool 取出的buf里，用完后需要放回；
+// 没有扩展编码的服务端直接使用原数据，buf为nil
+func encodeMessage(wc *WsConn, opcode MessageType, data []byte) (payload []byte, rsv uint16, buf *bytes.Buffer, err error) {
+	buf = getBuffer()
+	bc := bufferCloser{buf}
+	w, rsv, err := wc.wrapMessageWriter(opcode, bc)
+	if err != nil {
+		putBuffer(buf)
+		return nil, 0, nil, err
+	}
+	if w == io.WriteCloser(bc) {
+		if wc.IsServer {
+			putBuffer(buf)
+			return data, rsv, nil, nil
+		}
+		//客户端的帧会原地掩码，不能修改调用方的数据
+		buf.Write(data)
+		return buf.Bytes(), rsv, buf, nil
 	}
 
-	//追加剩余数据
-	if end < s {
-		frames = append(frames, constructDataFrame(data[end:], noMask, ContinuationFrame))
+	if _, err = w.Write(data); err == nil {
+		err = w.Close()
 	}
+	if err != nil {
+		putBuffer(buf)
+		return nil, 0, nil, err
+	}
+	return buf.Bytes(), rsv, buf, nil
+}
 
-	//分片传输，第一个帧的opcode设置为0x1或0x2，其余位都是0
-	frames[0].OpCode = uint16(opcode)
+// bufferCloser 关闭时什么都不做的 bytes.Buffer
+type bufferCloser struct {
+	*bytes.Buffer
+}
 
-	//最后一位的Fin为1,其余要设置为0
-	frames[len(frames)-1].Fin = 1
+func (b bufferCloser) Close() error {
+	return nil
+}
+
+// shardFrames 把一条消息的负载按 shardSize 切分成帧依次交给fn：第一个帧的opcode为消息类型并带上rsv位，
+// 其余为延续帧，最后一个帧设置fin；负载为空时也有一个帧。客户端的帧会在原地掩码
+func shardFrames(opcode MessageType, data []byte, rsv uint16, isServer bool, fn func(frame *Frame) error) error {
+	for start := 0; ; start += shardSize {
+		end := start + shardSize
+		if end > len(data) {
+			end = len(data)
+		}
 
-	return frames
+		frameType := ContinuationFrame
+		if start == 0 {
+			frameType = opcode
+		}
+		frame := constructFrame(frameType, end == len(data), isServer)
+		if start == 0 {
+			frame.SetRSV(rsv)
+		}
+		frame.SetPayload(data[start:end])
+
+		if err := fn(frame); err != nil {
+			return err
+		}
+		if end == len(data) {
+			return nil
+		}
+	}
 }
 
 // sendControlFrame 发送控制帧（ping、pong、close）
 func sendControlFrame(wc *WsConn, msgType MessageType, payload []byte) (err error) {
+	if len(payload) > maxControlFramePayloadByteSize {
+		return ErrControlFrameTooBig
+	}
+	wc.logger.debug("c.send control frame", "type", msgType, "payload", wc.logger.payload(payload))
+	//客户端的帧会原地掩码，不能修改调用方的数据
+	if !wc.IsServer {
+		payload = append([]byte(nil), payload...)
+	}
 	frame := constructControlFrame(msgType, wc.IsServer, payload)
-	log.Printf("control frame...")
 	if err = sendFrame(wc, frame); err != nil {
-		log.Printf("c.send failed to c.sendFrame err=%v", err)
+		wc.logger.debug("c.send failed to c.sendFrame", "err", err)
 		return
 	}
 
 	return nil
 }
 
-// sendFrame 发送完好的帧到连接里
+// sendFrame 发送完好的帧到连接里，每个帧都在 WsConn.writeMu 的保护下完整写入
 func sendFrame(wc *WsConn, frame *Frame) error {
+	wc.writeMu.Lock()
+
+	//扩展需要逐帧变换时，先去掉掩码，变换后重新掩码并矫正负载长度
+	if wc.hasFrameTransformer() {
+		if frame.Mask == 1 {
+			frame.MaskPayload()
+		}
+		if err := wc.writeFrameExtensions(frame); err != nil {
+			wc.writeMu.Unlock()
+			return err
+		}
+		frame.SetPayload(frame.Payload)
+	}
+
 	//校验帧
 	if err := CheckFrameWithoutPayload(frame); err != nil {
+		wc.writeMu.Unlock()
 		//协议问题关闭连接
 		if err := wc.CloseWrongProtocol(); err != nil {
 			return err
 		}
 		return err
 	}
+	defer wc.writeMu.Unlock()
 
-	//序列化为帧协议字节流
-	frameBytes := FrameToBytes(frame)
+	//发送关闭帧之后不能再发送任何帧
+	if wc.closeSent {
+		return ErrCloseSent
+	}
+	if MessageType(frame.OpCode) == ConnectionCloseFrame {
+		wc.closeSent = true
+	}
 
-	//将序列化的字节流数据写入连接的缓存区
-	if _, err := wc.BufWR.Write(frameBytes); err != nil {
+	bw := wc.writer()
+	defer wc.releaseWriter(bw)
+
+	//帧头部序列化到连接的头部缓冲区，负载直接写入连接的缓存区，不再拼接成一个字节流
+	if _, err := bw.Write(appendFrameHeader(wc.headerBuf[:0], frame)); err != nil {
+		return err
+	}
+	if _, err := bw.Write(frame.Payload); err != nil {
 		return err
 	}
 
 	//将数据从缓存里移到io
-	if err := wc.BufWR.Flush(); err != nil {
+	if err := bw.Flush(); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// constructDataFrame 构造数据类型的帧（binary、text）
-func constructDataFrame(payload []byte, noMask bool, msgType MessageType) *Frame {
-	final := msgType != ContinuationFrame
-	frame := constructFrame(msgType, final, noMask)
-	frame.SetPayload(payload)
+// writer 取得写缓冲区，调用方持有 writeMu。连接第一次发送时才分配自己的写缓冲区；
+// 设置了写缓冲池或加入了事件循环时，每次发送从池里借用
+func (wc *WsConn) writer() *bufio.Writer {
+	switch {
+	case wc.BufWR != nil:
+		return wc.BufWR
+	case wc.writePool != nil:
+		if bw, ok := wc.writePool.Get().(*bufio.Writer); ok {
+			bw.Reset(wc.Conn)
+			return bw
+		}
+		return bufio.NewWriterSize(wc.Conn, wc.writeBufferSize)
+	case wc.poll != nil:
+		return getWriter(wc.Conn)
+	}
+	wc.BufWR = bufio.NewWriterSize(wc.Conn, wc.writeBufferSize)
+	return wc.BufWR
+}
 
-	return frame
+// releaseWriter 归还借用的写缓冲区，调用方持有 writeMu
+func (wc *WsConn) releaseWriter(bw *bufio.Writer) {
+	switch {
+	case bw == wc.BufWR:
+	case wc.writePool != nil:
+		bw.Reset(nil)
+		wc.writePool.Put(bw)
+	default:
+		putWriter(bw)
+	}
 }
 
 // constructControlFrame 构造控制帧（ping、pong、close）
@@ -419,72 +655,179 @@ func constructFrame(msgType MessageType, final bool, noMask bool) *Frame {
 
 // CloseRight 正常关闭连接
 func (wc *WsConn) CloseRight() error {
-	return close(wc, CloseRight)
+	return close(wc, CloseRight, Error(CloseRight))
 }
 
 // CloseAsideLeaving 某端点离开连接
 func (wc *WsConn) CloseAsideLeaving() error {
-	return close(wc, CloseAsideLeaving)
+	return close(wc, CloseAsideLeaving, Error(CloseAsideLeaving))
 }
 
 // CloseWrongProtocol 表示端点由于协议错误正在终止连接
 func (wc *WsConn) CloseWrongProtocol() error {
-	return close(wc, CloseWrongProtocol)
+	return close(wc, CloseWrongProtocol, Error(CloseWrongProtocol))
 }
 
 // CloseNotAccept 关闭连接，因某端点接收到一种它不能接受的数据
 func (wc *WsConn) CloseNotAccept() error {
-	return close(wc, CloseNotAccept)
+	return close(wc, CloseNotAccept, Error(CloseNotAccept))
 }
 
-// CloseAbnormal 异常关闭
+// CloseAbnormal 异常关闭，1006不能出现在关闭帧里，因此直接关闭底层tcp连接
 func (wc *WsConn) CloseAbnormal() error {
-	return close(wc, CloseAbnormal)
+	return closeTcp(wc)
 }
 
 // CloseDifferentMsgType 表示端点正在终止连接 ，因为它在消息中接收到与消息类型不一致的数据
 func (wc *WsConn) CloseDifferentMsgType() error {
-	return close(wc, CloseDifferentMsgType)
+	return close(wc, CloseDifferentMsgType, Error(CloseDifferentMsgType))
 }
 
 // CloseInternalError 端点内部错误，关闭连接
 func (wc *WsConn) CloseInternalError() error {
-	return close(wc, CloseInternalError)
+	return close(wc, CloseInternalError, Error(CloseInternalError))
 }
 
 // CloseTooBigData 表示端点正在终止连接 ，因为它收到了一条太大而无法处理的消息。
 func (wc *WsConn) CloseTooBigData() error {
-	return close(wc, CloseTooBigData)
+	return close(wc, CloseTooBigData, Error(CloseTooBigData))
+}
+
+// CloseWithReason 以指定的状态码和原因发起关闭握手，应用自定义的状态码应在3000~4999之间，
+// 原因不能超过123个字节，并且必须是合法的utf-8编码
+func (wc *WsConn) CloseWithReason(code int, reason string) error {
+	if !isValidCloseCode(code) {
+		return errCloseCode
+	}
+	if len(reason) > maxControlFramePayloadByteSize-2 {
+		return errCloseReason
+	}
+	if !utf8.ValidString(reason) {
+		return ErrInvalidUTF8
+	}
+	return close(wc, code, reason)
 }
 
-func close(wc *WsConn, closeCode int) (err error) {
-	p := make([]byte, 2, 16)
+// close 发送关闭帧发起关闭握手，之后不能再发送数据；等待对端回复关闭帧后关闭底层tcp连接，
+// 超过 closeHandshakeTimeout 仍未收到时直接关闭。对端的关闭帧需要由读协程读取
+func close(wc *WsConn, closeCode int, reason string) (err error) {
+	p := make([]byte, 2, 2+len(reason))
 	//前两个字节放入code
 	binary.BigEndian.PutUint16(p[:2], uint16(closeCode))
 	//后续放入原因
-	p = append(p, []byte(Error(closeCode))...)
-	log.Printf("c.close sending close frame, payload=%s", p)
+	p = append(p, reason...)
+	wc.logger.debug("c.close sending close frame", "code", closeCode, "reason", reason)
 
 	//发送关闭帧
 	if err = sendControlFrame(wc, ConnectionCloseFrame, p); err != nil {
-		log.Printf("c.handleClose failed to c.sendControlFrame, err=%v", err)
+		wc.logger.debug("c.close failed to c.sendControlFrame", "err", err)
+		if err != ErrCloseSent {
+			_ = closeTcp(wc)
+		}
 		return
 	}
 
-	//关闭底层tcp连接
-	if wc.Conn != nil {
-		defer func(wc *WsConn) {
-			err := closeTcp(wc)
-			if err != nil {
-				log.Println("close tcp err: ", err)
-			}
-		}(wc)
-	}
+	//等待对端的关闭帧，读协程可能阻塞在读上，用读超时唤醒它
+	_ = wc.Conn.SetReadDeadline(time.Now().Add(closeHandshakeTimeout))
+	go func(wc *WsConn) {
+		timer := time.NewTimer(closeHandshakeTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-wc.closeRecv:
+		case <-timer.C:
+		}
+		if err := closeTcp(wc); err != nil {
+			wc.logger.debug("c.close failed to closeTcp", "err", err)
+		}
+	}(wc)
 
 	return nil
 }
 
-// closeTcp 关闭底层tcp
+// handleClose 处理对端的关闭帧，返回对端的 CloseError；
+// 由对端发起关闭时，回复相同的状态码，之后关闭底层tcp连接
+func handleClose(wc *WsConn, frame *Frame) error {
+	ce, err := parseClosePayload(frame.Payload)
+	if err != nil {
+		wc.logger.warn("c.handleClose got invalid close frame", "err", err)
+		if err == ErrInvalidUTF8 {
+			_ = wc.CloseDifferentMsgType()
+		} else {
+			_ = wc.CloseWrongProtocol()
+		}
+		_ = closeTcp(wc)
+		return err
+	}
+
+	wc.closeOnce.Do(func() {
+		wc.closeErr = ce
+		wc.closeRecv <- struct{}{}
+	})
+
+	var p []byte
+	if ce.Code != CloseNoStatus {
+		p = make([]byte, 2)
+		binary.BigEndian.PutUint16(p, uint16(ce.Code))
+	}
+	if err = sendControlFrame(wc, ConnectionCloseFrame, p); err != nil && err != ErrCloseSent {
+		wc.logger.debug("c.handleClose failed to c.sendControlFrame", "err", err)
+	}
+
+	if err = closeTcp(wc); err != nil {
+		wc.logger.debug("c.handleClose failed to closeTcp", "err", err)
+	}
+	return ce
+}
+
+// closeTcp 关闭底层tcp，可以重复调用
 func closeTcp(wc *WsConn) error {
-	return wc.Conn.Close()
+	var err error
+	wc.tcpCloseOnce.Do(func() {
+		err = wc.Conn.Close()
+
+		wc.hookMu.Lock()
+		wc.tcpClosed = true
+		hooks := wc.closeHooks
+		wc.closeHooks = nil
+		wc.hookMu.Unlock()
+
+		for _, hook := range hooks {
+			hook()
+		}
+	})
+	return err
+}
+
+// onClose 注册关闭底层tcp连接后的回调，连接已经关闭时立即调用。回调里不能再调用 closeTcp
+func (wc *WsConn) onClose(hook func()) {
+	wc.hookMu.Lock()
+	if wc.tcpClosed {
+		wc.hookMu.Unlock()
+		hook()
+		return
+	}
+	wc.closeHooks = append(wc.closeHooks, hook)
+	wc.hookMu.Unlock()
+}
+
+// writePreparedFrames 把已经序列化好的一条完整消息的帧写入连接，调用方保证这些帧对该连接有效
+func writePreparedFrames(wc *WsConn, frames []byte) error {
+	//与其他数据消息互斥，保证分片连续
+	wc.msgMu.Lock()
+	defer wc.msgMu.Unlock()
+
+	wc.writeMu.Lock()
+	defer wc.writeMu.Unlock()
+
+	if wc.closeSent {
+		return ErrCloseSent
+	}
+	bw := wc.writer()
+	defer wc.releaseWriter(bw)
+
+	if _, err := bw.Write(frames); err != nil {
+		return err
+	}
+	return bw.Flush()
 }
@@ -0,0 +1,571 @@
+package mini_websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func wsURL(s *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+// newTestServer 每个升级成功的连接交给handler处理，handler返回后连接不会被关闭
+func newTestServer(t *testing.T, ug *upGrader, handler func(c *WsConn, r *http.Request)) *httptest.Server {
+	t.Helper()
+	if ug == nil {
+		ug = &DefaultUpGrader
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := ug.UpGrade(r, w)
+		if err != nil {
+			return
+		}
+		handler(c, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// dialTest 拨号到测试服务器，d为nil时使用 DefaultDialer
+func dialTest(t *testing.T, s *httptest.Server, d *Dialer) *WsConn {
+	t.Helper()
+	if d == nil {
+		d = DefaultDialer
+	}
+	c, err := d.Dial(context.Background(), wsURL(s), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = closeTcp(c) })
+	return c
+}
+
+// concurrentPayload 第seq条消息的内容：前缀标明发送方，其余字节都相同，分片交错时校验不通过
+func concurrentPayload(sender, seq int) []byte {
+	prefix := fmt.Sprintf("%d-%d|", sender, seq)
+	fill := bytes.Repeat([]byte{byte('a' + (sender*7+seq)%26)}, 2*shardSize+sender*1000+seq)
+	return append([]byte(prefix), fill...)
+}
+
+func checkConcurrentPayload(p []byte) (sender, seq int, err error) {
+	i := bytes.IndexByte(p, '|')
+	if i < 0 {
+		return 0, 0, fmt.Errorf("消息没有前缀: %q", p[:minInt(len(p), 20)])
+	}
+	if _, err = fmt.Sscanf(string(p[:i]), "%d-%d", &sender, &seq); err != nil {
+		return 0, 0, err
+	}
+	if !bytes.Equal(p, concurrentPayload(sender, seq)) {
+		return 0, 0, fmt.Errorf("消息%d-%d被破坏，长度%d", sender, seq, len(p))
+	}
+	return sender, seq, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// TestConcurrentWrites 多个协程并发以 SendMessage、NextWriter 和 WritePreparedMessage 发送超过 shardSize 的消息，
+// 同时读协程自动回复对端持续发来的ping，
+// 每条消息都应完整到达，分片不交错
+func TestConcurrentWrites(t *testing.T) {
+	const senders, perSender = 6, 8
+
+	var pongs int64
+	type result struct {
+		next map[int]int
+		err  error
+	}
+	done := make(chan result, 1)
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		c.SetPongHandler(func([]byte) error {
+			atomic.AddInt64(&pongs, 1)
+			return nil
+		})
+		stop := make(chan struct{}, 1)
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := c.Ping(); err != nil {
+					return
+				}
+			}
+		}()
+		defer func() { stop <- struct{}{} }()
+
+		next := make(map[int]int)
+		for i := 0; i < senders*perSender; i++ {
+			_, p, err := c.ReadMessage()
+			if err != nil {
+				done <- result{err: err}
+				return
+			}
+			sender, seq, err := checkConcurrentPayload(p)
+			if err != nil {
+				done <- result{err: err}
+				return
+			}
+			//同一发送方的消息按发送顺序到达
+			if seq != next[sender] {
+				done <- result{err: fmt.Errorf("发送方%d的消息乱序: 收到%d，应为%d", sender, seq, next[sender])}
+				return
+			}
+			next[sender]++
+		}
+		done <- result{next: next}
+	})
+
+	c := dialTest(t, s, nil)
+	//客户端的读协程处理服务端的ping，回复pong与发送协程竞争写锁
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(sender int) {
+			defer wg.Done()
+			for seq := 0; seq < perSender; seq++ {
+				p := concurrentPayload(sender, seq)
+				var err error
+				switch (sender + seq) % 3 {
+				case 0:
+					err = c.SendMessage(string(p))
+				case 1:
+					err = writeInPieces(c, p)
+				default:
+					var pm *PreparedMessage
+					if pm, err = NewPreparedMessage(TextFrame, p); err == nil {
+						err = c.WritePreparedMessage(pm)
+					}
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	for i := 0; i < senders; i++ {
+		if res.next[i] != perSender {
+			t.Fatalf("发送方%d只收到%d条消息", i, res.next[i])
+		}
+	}
+	if atomic.LoadInt64(&pongs) == 0 {
+		t.Fatal("没有收到pong")
+	}
+}
+
+// writeInPieces 通过 NextWriter 分多次写入一条text消息
+func writeInPieces(c *WsConn, p []byte) error {
+	w, err := c.NextWriter(TextFrame)
+	if err != nil {
+		return err
+	}
+	for len(p) > 0 {
+		n := minInt(len(p), 10000)
+		if _, err = w.Write(p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return w.Close()
+}
+
+// rawFrame 序列化一个帧，用于构造违反协议的输入；mask为true时按客户端的方式掩码
+func rawFrame(mt MessageType, fin bool, rsv uint16, mask bool, payload []byte) []byte {
+	frame := constructFrame(mt, fin, !mask)
+	frame.SetRSV(rsv)
+	frame.SetPayload(append([]byte(nil), payload...))
+	return FrameToBytes(frame)
+}
+
+// writeRaw 绕过发送方法的校验，直接把字节写入连接
+func writeRaw(t *testing.T, c *WsConn, p []byte) {
+	t.Helper()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	bw := c.writer()
+	defer c.releaseWriter(bw)
+	if _, err := bw.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectCloseCode 读取c直到出错，错误应为状态码为code的 CloseError
+func expectCloseCode(t *testing.T, c *WsConn, code int) {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := c.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var ce *CloseError
+		if !errors.As(err, &ce) || ce.Code != code {
+			t.Fatalf("err = %v, want close code %d", err, code)
+		}
+		return
+	}
+}
+
+// TestCloseHandshake 对端回复相同的状态码，发送关闭帧后不能再发送数据
+func TestCloseHandshake(t *testing.T) {
+	tests := []struct {
+		name   string
+		close  func(c *WsConn) error
+		code   int
+		reason string
+		echo   int
+	}{
+		{"normal", (*WsConn).CloseRight, CloseRight, Error(CloseRight), CloseRight},
+		{"going away", (*WsConn).CloseAsideLeaving, CloseAsideLeaving, Error(CloseAsideLeaving), CloseAsideLeaving},
+		{"application code", func(c *WsConn) error { return c.CloseWithReason(4000, "bye") }, 4000, "bye", 4000},
+		{"no status", func(c *WsConn) error {
+			writeRaw(t, c, rawFrame(ConnectionCloseFrame, true, 0, true, nil))
+			return nil
+		}, CloseNoStatus, "", CloseNoStatus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errc := make(chan error, 2)
+			s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+				_, _, err := c.ReadMessage()
+				errc <- err
+				//收到关闭帧后继续读取返回同样的错误，发送返回 ErrCloseSent
+				_, _, err = c.ReadMessage()
+				errc <- err
+				if err := c.SendMessage("late"); err != ErrCloseSent {
+					t.Errorf("server send after close = %v, want ErrCloseSent", err)
+				}
+			})
+			c := dialTest(t, s, nil)
+			if err := tt.close(c); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2; i++ {
+				var ce *CloseError
+				if err := <-errc; !errors.As(err, &ce) || ce.Code != tt.code || ce.Reason != tt.reason {
+					t.Fatalf("server err = %v, want code %d reason %q", err, tt.code, tt.reason)
+				}
+			}
+			expectCloseCode(t, c, tt.echo)
+			if err := c.SendMessage("late"); err != ErrCloseSent {
+				t.Fatalf("client send after close = %v, want ErrCloseSent", err)
+			}
+		})
+	}
+}
+
+func TestCloseWithReasonInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   int
+		reason string
+		err    error
+	}{
+		{"no status", CloseNoStatus, "", errCloseCode},
+		{"abnormal", CloseAbnormal, "", errCloseCode},
+		{"reserved", 1004, "", errCloseCode},
+		{"below range", 999, "", errCloseCode},
+		{"above range", 5000, "", errCloseCode},
+		{"long reason", 4000, strings.Repeat("r", 124), errCloseReason},
+		{"invalid utf-8", 4000, "\xff", ErrInvalidUTF8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewWsConn(&writeConn{}, true, 0, 0, 0)
+			if err := c.CloseWithReason(tt.code, tt.reason); err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+// TestCloseInvalidPayload 关闭帧的负载不合法时以1002关闭
+func TestCloseInvalidPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"one byte", []byte{0x03}},
+		{"reserved code", []byte{0x03, 0xec}},
+		{"unassigned code", []byte{0x0b, 0xb8 - 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+				_, _, _ = c.ReadMessage()
+			})
+			c := dialTest(t, s, nil)
+			writeRaw(t, c, rawFrame(ConnectionCloseFrame, true, 0, true, tt.payload))
+			expectCloseCode(t, c, CloseWrongProtocol)
+		})
+	}
+}
+
+// TestReadLimit 超过读取限制的消息以1009关闭：帧头部声明的长度在读取负载之前检查，分片按累计长度检查
+func TestReadLimit(t *testing.T) {
+	const limit = 100
+	big := rawFrame(BinaryFrame, true, 0, true, make([]byte, limit+1))
+	tests := []struct {
+		name     string
+		compress int
+		frames   [][]byte
+		code     int
+	}{
+		{"at limit", NoCompression, [][]byte{rawFrame(BinaryFrame, true, 0, true, make([]byte, limit))}, CloseRight},
+		//只发送头部，负载还没有到达就应关闭
+		{"header only", NoCompression, [][]byte{big[:8]}, CloseTooBigData},
+		{"fragments", NoCompression, [][]byte{
+			rawFrame(BinaryFrame, false, 0, true, make([]byte, 60)),
+			rawFrame(ContinuationFrame, false, 0, true, make([]byte, 30)),
+			rawFrame(ContinuationFrame, true, 0, true, make([]byte, 11)),
+		}, CloseTooBigData},
+		{"fragments with ping", NoCompression, [][]byte{
+			rawFrame(TextFrame, false, 0, true, make([]byte, 60)),
+			rawFrame(PingFrame, true, 0, true, make([]byte, 50)),
+			rawFrame(ContinuationFrame, true, 0, true, make([]byte, 40)),
+		}, CloseRight},
+		{"decompressed", BestSpeed, nil, CloseTooBigData},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ug := NewUpGrader(0, 0, 0, nil, nil, tt.compress)
+			ug.ReadLimit = limit
+			errc := make(chan error, 1)
+			s := newTestServer(t, &ug, func(c *WsConn, r *http.Request) {
+				_, _, err := c.ReadMessage()
+				if err == nil {
+					err = c.CloseRight()
+				}
+				errc <- err
+			})
+			c := dialTest(t, s, &Dialer{CompressLevel: tt.compress})
+			for _, f := range tt.frames {
+				writeRaw(t, c, f)
+			}
+			if tt.compress != NoCompression {
+				//压缩后远小于限制，解压后超过限制
+				if err := c.SendMessage(strings.Repeat("a", 10*limit)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := <-errc
+			if tt.code == CloseTooBigData && !errors.Is(err, ErrReadLimit) {
+				t.Fatalf("server err = %v, want ErrReadLimit", err)
+			}
+			expectCloseCode(t, c, tt.code)
+		})
+	}
+}
+
+// TestProtocolErrors 违反RFC 6455的帧以1002关闭，读取方法返回对应的错误
+func TestProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		err    error
+	}{
+		{"unmasked client frame", [][]byte{rawFrame(TextFrame, true, 0, false, []byte("a"))}, ErrFrameNotMasked},
+		{"fragmented ping", [][]byte{rawFrame(PingFrame, false, 0, true, nil)}, ErrControlFrameFragmented},
+		{"big ping", [][]byte{rawFrame(PingFrame, true, 0, true, make([]byte, 126))}, ErrControlFrameTooBig},
+		{"continuation without start", [][]byte{rawFrame(ContinuationFrame, true, 0, true, []byte("a"))}, ErrContinuationNoStart},
+		{"interleaved data", [][]byte{
+			rawFrame(TextFrame, false, 0, true, []byte("a")),
+			rawFrame(BinaryFrame, true, 0, true, []byte("b")),
+		}, ErrDataFrameInterleaved},
+		{"big ping between fragments", [][]byte{
+			rawFrame(TextFrame, false, 0, true, []byte("a")),
+			rawFrame(PingFrame, true, 0, true, make([]byte, 126)),
+		}, ErrControlFrameTooBig},
+		{"reserved opcode", [][]byte{rawFrame(0x7, true, 0, true, nil)}, errFrameOpCodeNotAccept},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errc := make(chan error, 1)
+			s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+				_, _, err := c.ReadMessage()
+				errc <- err
+			})
+			c := dialTest(t, s, nil)
+			for _, f := range tt.frames {
+				writeRaw(t, c, f)
+			}
+			if err := <-errc; !errors.Is(err, tt.err) {
+				t.Fatalf("server err = %v, want %v", err, tt.err)
+			}
+			expectCloseCode(t, c, CloseWrongProtocol)
+		})
+	}
+}
+
+// TestMaskedServerFrame 客户端收到带掩码的帧时以1002关闭
+func TestMaskedServerFrame(t *testing.T) {
+	errc := make(chan error, 1)
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		writeRaw(t, c, rawFrame(TextFrame, true, 0, true, []byte("masked")))
+		_, _, err := c.ReadMessage()
+		errc <- err
+	})
+	c := dialTest(t, s, nil)
+	if _, _, err := c.ReadMessage(); !errors.Is(err, ErrFrameMasked) {
+		t.Fatalf("err = %v, want %v", err, ErrFrameMasked)
+	}
+	var ce *CloseError
+	if err := <-errc; !errors.As(err, &ce) || ce.Code != CloseWrongProtocol {
+		t.Fatalf("server err = %v, want close code %d", err, CloseWrongProtocol)
+	}
+}
+
+// countingPool 统计借出和归还次数的 BufferPool
+type countingPool struct {
+	pool       sync.Pool
+	gets, puts int64
+}
+
+func (p *countingPool) Get() interface{} {
+	atomic.AddInt64(&p.gets, 1)
+	return p.pool.Get()
+}
+
+func (p *countingPool) Put(v interface{}) {
+	atomic.AddInt64(&p.puts, 1)
+	p.pool.Put(v)
+}
+
+// TestLazyBuffers 升级后的连接在第一次读写时才分配缓冲区，设置 WriteBufferPool 时发送完就归还写缓冲区
+func TestLazyBuffers(t *testing.T) {
+	tests := []struct {
+		name string
+		pool *countingPool
+	}{
+		{"own buffer", nil},
+		{"write pool", &countingPool{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ug := DefaultUpGrader
+			if tt.pool != nil {
+				ug.WriteBufferPool = tt.pool
+			}
+			errc := make(chan error, 1)
+			s := newTestServer(t, &ug, func(c *WsConn, r *http.Request) {
+				errc <- func() error {
+					if c.BufRD != nil || c.BufWR != nil {
+						return errors.New("buffers allocated before first use")
+					}
+					for i := 0; i < 3; i++ {
+						if err := c.SendMessage("hi"); err != nil {
+							return err
+						}
+					}
+					if (c.BufWR == nil) != (tt.pool != nil) {
+						return fmt.Errorf("BufWR = %v with pool %v", c.BufWR != nil, tt.pool != nil)
+					}
+					if _, _, err := c.ReadMessage(); err != nil {
+						return err
+					}
+					if c.BufRD == nil {
+						return errors.New("no read buffer after reading")
+					}
+					return nil
+				}()
+			})
+
+			c := dialTest(t, s, nil)
+			for i := 0; i < 3; i++ {
+				if _, p, err := c.ReadMessage(); err != nil || string(p) != "hi" {
+					t.Fatalf("got %q, %v", p, err)
+				}
+			}
+			if err := c.SendMessage("done"); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			if p := tt.pool; p != nil {
+				gets, puts := atomic.LoadInt64(&p.gets), atomic.LoadInt64(&p.puts)
+				if gets != 3 || puts != 3 {
+					t.Fatalf("pool gets %d, puts %d, want 3 and 3", gets, puts)
+				}
+			}
+		})
+	}
+}
+
+// TestUpGradeKeepsEarlyFrames 客户端紧跟在握手请求后发送的帧不会丢失
+func TestUpGradeKeepsEarlyFrames(t *testing.T) {
+	got := make(chan string, 1)
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		_, p, err := c.ReadMessage()
+		if err != nil {
+			p = []byte(err.Error())
+		}
+		got <- string(p)
+	})
+
+	nc, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	req := "GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + GenerateSWK() + "\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	if _, err = nc.Write(append([]byte(req), rawFrame(TextFrame, true, 0, true, []byte("early"))...)); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-got; p != "early" {
+		t.Fatalf("got %q", p)
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	tests := []struct{ in, want int }{
+		{-1, defaultReadBufferSize},
+		{0, defaultReadBufferSize},
+		{1, minReadBufferSize},
+		{minReadBufferSize, minReadBufferSize},
+		{4096, 4096},
+		{maxReadBufferSize + 1, maxReadBufferSize},
+	}
+	for _, tt := range tests {
+		if got := bufferSize(tt.in, defaultReadBufferSize, minReadBufferSize, maxReadBufferSize); got != tt.want {
+			t.Fatalf("bufferSize(%d) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
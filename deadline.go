@@ -0,0 +1,123 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"context"
+	"time"
+)
+
+// aLongTimeAgo 设置为连接的超时时间后，阻塞在连接上的读写会立即返回
+var aLongTimeAgo = time.Unix(1, 0)
+
+// SetReadDeadline 设置底层连接的读超时时间，t为零值时不超时。
+// 读超时后一条消息可能只读了一半，连接已不可用，应当关闭
+func (wc *WsConn) SetReadDeadline(t time.Time) error {
+	wc.deadlineMu.Lock()
+	wc.readDeadline = t
+	wc.deadlineMu.Unlock()
+	return wc.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline 设置底层连接的写超时时间，t为零值时不超时。
+// 写超时后一个帧可能只写了一半，连接已不可用，应当关闭
+func (wc *WsConn) SetWriteDeadline(t time.Time) error {
+	wc.deadlineMu.Lock()
+	wc.writeDeadline = t
+	wc.deadlineMu.Unlock()
+	return wc.Conn.SetWriteDeadline(t)
+}
+
+// ReadMessageContext 同 ReadMessage，ctx结束时中断阻塞的读取并返回 ctx.Err()，
+// 被中断的连接已不可用，应当关闭
+func (wc *WsConn) ReadMessageContext(ctx context.Context) (mt MessageType, msg []byte, err error) {
+	err = readContext(ctx, wc, func() error {
+		mt, msg, err = wc.ReadMessage()
+		return err
+	})
+	if err != nil {
+		return NoFrame, nil, err
+	}
+	return mt, msg, nil
+}
+
+// WriteMessageContext 发送一条text、binary或扩展占用opcode的消息，ctx结束时中断阻塞的写入并返回 ctx.Err()，
+// 被中断的连接已不可用，应当关闭
+func (wc *WsConn) WriteMessageContext(ctx context.Context, mt MessageType, data []byte) error {
+	return writeContext(ctx, wc, func() error {
+		if mt == TextFrame || mt == BinaryFrame {
+			return sendDataFrame(wc, data, mt)
+		}
+		return wc.SendExtMessage(mt, data)
+	})
+}
+
+// PingContext 同 Ping，ctx结束时中断阻塞的写入并返回 ctx.Err()
+func (wc *WsConn) PingContext(ctx context.Context) error {
+	return writeContext(ctx, wc, wc.Ping)
+}
+
+// readContext 在ctx的控制下执行读操作
+func readContext(ctx context.Context, wc *WsConn, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stop := watchContext(ctx, wc.Conn.SetReadDeadline)
+	err := fn()
+	if stop() {
+		if err != nil {
+			return ctx.Err()
+		}
+		//操作恰好在ctx结束时完成，恢复调用方设置的超时时间
+		wc.deadlineMu.Lock()
+		_ = wc.Conn.SetReadDeadline(wc.readDeadline)
+		wc.deadlineMu.Unlock()
+	}
+	return err
+}
+
+// writeContext 在ctx的控制下执行写操作
+func writeContext(ctx context.Context, wc *WsConn, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stop := watchContext(ctx, wc.Conn.SetWriteDeadline)
+	err := fn()
+	if stop() {
+		if err != nil {
+			return ctx.Err()
+		}
+		wc.deadlineMu.Lock()
+		_ = wc.Conn.SetWriteDeadline(wc.writeDeadline)
+		wc.deadlineMu.Unlock()
+	}
+	return err
+}
+
+// watchContext ctx结束时把连接的超时时间设置为过去的时间，中断阻塞在连接上的读写。
+// 操作结束后调用返回的stop停止监听，stop返回ctx是否已经中断过连接
+func watchContext(ctx context.Context, setDeadline func(time.Time) error) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+
+	done := make(chan struct{}, 1)
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = setDeadline(aLongTimeAgo)
+			interrupted <- true
+		case <-done:
+			interrupted <- false
+		}
+	}()
+
+	return func() bool {
+		done <- struct{}{}
+		return <-interrupted
+	}
+}
@@ -0,0 +1,158 @@
+package mini_websocket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newSilentListener 接受tcp连接但从不回复，用于让握手阻塞
+func newSilentListener(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			//读到客户端断开为止
+			go func() {
+				_, _ = io.Copy(ioutil.Discard, nc)
+				_ = nc.Close()
+			}()
+		}
+	}()
+	return "ws://" + ln.Addr().String()
+}
+
+func TestReadMessageContext(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+		err  error
+	}{
+		{"canceled", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			return ctx, cancel
+		}, context.Canceled},
+		{"deadline", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}, context.DeadlineExceeded},
+		{"already canceled", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx, cancel
+		}, context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {})
+			c := dialTest(t, s, nil)
+
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			start := time.Now()
+			if _, _, err := c.ReadMessageContext(ctx); err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if d := time.Since(start); d > 2*time.Second {
+				t.Fatalf("read returned after %v", d)
+			}
+		})
+	}
+}
+
+// TestReadMessageContextDone ctx没有结束时照常读取，之后的读取不受ctx影响
+func TestReadMessageContextDone(t *testing.T) {
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		_ = c.SendMessage("one")
+		time.Sleep(100 * time.Millisecond)
+		_ = c.SendMessage("two")
+	})
+	c := dialTest(t, s, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, p, err := c.ReadMessageContext(ctx); err != nil || string(p) != "one" {
+		t.Fatalf("got %q, %v", p, err)
+	}
+	<-ctx.Done()
+	if _, p, err := c.ReadMessage(); err != nil || string(p) != "two" {
+		t.Fatalf("got %q, %v", p, err)
+	}
+}
+
+// TestWriteMessageContext 对端不读取时，ctx结束中断阻塞的写入
+func TestWriteMessageContext(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	c := NewWsConn(local, true, 0, 0, 0)
+	defer closeTcp(c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.WriteMessageContext(ctx, BinaryFrame, make([]byte, 1<<20)); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := c.PingContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("ping err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSetReadDeadline(t *testing.T) {
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {})
+	c := dialTest(t, s, nil)
+
+	if err := c.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := c.ReadMessage()
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+}
+
+// TestDialContextCanceled ctx结束时中断阻塞的握手
+func TestDialContextCanceled(t *testing.T) {
+	url := newSilentListener(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	c, err := (&Dialer{}).Dial(ctx, url, nil)
+	if err != context.Canceled || c != nil {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+}
+
+// TestUpGradeContextCanceled ctx已经结束时不升级，客户端收到503
+func TestUpGradeContextCanceled(t *testing.T) {
+	errc := make(chan error, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		cancel()
+		_, err := DefaultUpGrader.UpGradeContext(ctx, r, w)
+		errc <- err
+	}))
+	defer s.Close()
+
+	_, err := DefaultDialer.Dial(context.Background(), wsURL(s), nil)
+	if !errors.Is(err, ErrBadHandshake) {
+		t.Fatalf("dial err = %v, want ErrBadHandshake", err)
+	}
+	if err = <-errc; err != context.Canceled {
+		t.Fatalf("upgrade err = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,272 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBadScheme    = errors.New("websocket url的scheme应该为ws或wss")
+	ErrBadHandshake = errors.New("websocket握手失败")
+)
+
+var DefaultDialer = &Dialer{
+	HandshakeTimeout: 10 * time.Second,
+	ReadBufferSize:   defaultReadBufferSize,
+	WriteBufferSize:  defaultWriteBufferSize,
+	ReadLimit:        defaultReadLimit,
+}
+
+// Dialer 客户端拨号，主动向服务端发起websocket连接
+type Dialer struct {
+	//握手超时时间，为0时不限制
+	HandshakeTimeout time.Duration
+	//指定底层网络连接的缓冲区大小，为0时使用默认的65535字节，最少256字节
+	ReadBufferSize, WriteBufferSize int
+	//写缓冲池，不为nil时连接只在发送时从池里借用写缓冲区，适合大量连接
+	WriteBufferPool BufferPool
+	//压缩等级，不为 NoCompression 时向服务端请求 permessage-deflate 扩展
+	CompressLevel int
+	//请求的扩展，按顺序写入 Sec-WebSocket-Extensions
+	Extensions []Extension
+	//请求的子协议，按优先级从高到低排列
+	Subprotocols []string
+	//子协议对应的编解码器，服务端选择的子协议在其中时设置为连接的编解码器，见 WsConn.SetCodec
+	Codecs map[string]Codec
+	//wss连接使用的tls配置，为nil时使用默认配置
+	TLSClientConfig *tls.Config
+	//建立底层tcp连接的函数，为nil时使用 net.Dialer
+	NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	//单条消息的最大字节数，为0时不限制，可以通过 WsConn.SetReadLimit 修改
+	ReadLimit int64
+	//连接的日志，为nil时不输出日志
+	Logger Logger
+	//debug日志里不输出消息负载，只输出负载长度
+	RedactPayload bool
+	//发送ping帧的间隔，为0时不开启保活，见 WsConn.StartKeepalive
+	PingInterval time.Duration
+	//等待pong帧的最长时间，为0时使用 PingInterval 的两倍
+	PongWait time.Duration
+}
+
+// Dial 向urlStr发起握手请求，header为附加的请求头，成功后返回客户端的 WsConn，
+// 客户端发送的帧都会做掩码处理
+func (d *Dialer) Dial(ctx context.Context, urlStr string, header http.Header) (*WsConn, error) {
+	return d.DialContext(ctx, urlStr, header)
+}
+
+// DialContext 同 Dial，ctx控制整个拨号和握手过程，ctx结束时中断阻塞的读写并返回 ctx.Err()；
+// 超过 HandshakeTimeout 时返回 ErrHandshakeTimeout。握手完成后ctx不再影响返回的连接
+func (d *Dialer) DialContext(ctx context.Context, urlStr string, header http.Header) (*WsConn, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	default:
+		return nil, ErrBadScheme
+	}
+
+	//握手超时同时限制拨号和握手请求的读写
+	dialCtx := ctx
+	var deadline time.Time
+	if d.HandshakeTimeout > 0 {
+		deadline = time.Now().Add(d.HandshakeTimeout)
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	netConn, err := d.dialNet(dialCtx, u)
+	if err != nil {
+		if ctx.Err() == nil && dialCtx.Err() == context.DeadlineExceeded {
+			err = ErrHandshakeTimeout
+		}
+		logTo(d.Logger, LevelWarn, "Dialer.Dial failed to dial", "host", u.Host, "err", err)
+		return nil, err
+	}
+
+	//建立连接，握手响应也从该连接的缓冲区读取，避免握手后紧跟的帧数据丢失
+	wsConn := NewWsConn(netConn, false, d.ReadBufferSize, d.WriteBufferSize, d.CompressLevel)
+	wsConn.writePool = d.WriteBufferPool
+	wsConn.SetReadLimit(d.ReadLimit)
+	wsConn.SetLogger(d.Logger, d.RedactPayload)
+
+	_ = netConn.SetDeadline(deadline)
+	stop := watchContext(ctx, netConn.SetDeadline)
+	err = d.handshake(wsConn, u, header)
+	if stop() && err != nil {
+		err = ctx.Err()
+	} else if isTimeout(err) {
+		err = ErrHandshakeTimeout
+	}
+	if err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+
+	//握手完成，清除握手设置的超时时间
+	_ = netConn.SetDeadline(time.Time{})
+	wsConn.SetCodec(d.Codecs[wsConn.subprotocol])
+	wsConn.StartKeepalive(d.PingInterval, d.PongWait)
+
+	return wsConn, nil
+}
+
+// dialNet 建立底层tcp连接，wss时完成tls握手
+func (d *Dialer) dialNet(ctx context.Context, u *url.URL) (net.Conn, error) {
+	hostPort, hostNoPort := hostPortNoPort(u)
+
+	netDial := d.NetDialContext
+	if netDial == nil {
+		netDial = (&net.Dialer{}).DialContext
+	}
+
+	netConn, err := netDial(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "https" {
+		return netConn, nil
+	}
+
+	cfg := d.TLSClientConfig
+	if cfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = hostNoPort
+	}
+
+	tlsConn := tls.Client(netConn, cfg)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// handshake 发送升级请求，并校验服务端的101响应
+func (d *Dialer) handshake(wc *WsConn, u *url.URL, header http.Header) error {
+	SWK := GenerateSWK()
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", SWK)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if len(d.Subprotocols) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(d.Subprotocols, ", "))
+	}
+	exts := d.extensions()
+	if len(exts) > 0 {
+		req.Header.Set("Sec-WebSocket-Extensions", offerExtensions(exts))
+	}
+
+	bw := wc.writer()
+	defer wc.releaseWriter(bw)
+	if err := req.Write(bw); err != nil {
+		wc.logger.debug("Dialer.handshake failed to write request", "err", err)
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		wc.logger.debug("Dialer.handshake failed to flush request", "err", err)
+		return err
+	}
+
+	resp, err := http.ReadResponse(wc.BufRD, req)
+	if err != nil {
+		wc.logger.debug("Dialer.handshake failed to read response", "err", err)
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("%w: 响应状态码为%d", ErrBadHandshake, resp.StatusCode)
+	}
+
+	if !HeaderContainsToken(resp.Header, "Upgrade", "websocket") {
+		return fmt.Errorf("%w: 'websocket' 没有包含在 'Upgrade' 内", ErrBadHandshake)
+	}
+
+	if !HeaderContainsToken(resp.Header, "Connection", "upgrade") {
+		return fmt.Errorf("%w: 'Upgrade' 字段没包含在 'Connection' 字段内", ErrBadHandshake)
+	}
+
+	if resp.Header.Get("Sec-WebSocket-Accept") != EncodeSWK(SWK) {
+		return fmt.Errorf("%w: Sec-WebSocket-Accept校验不通过", ErrBadHandshake)
+	}
+
+	//服务端只能选择一个客户端请求过的子协议
+	subprotocols := headerTokens(resp.Header, "Sec-WebSocket-Protocol")
+	if len(subprotocols) > 1 {
+		return fmt.Errorf("%w: 服务端响应了多个子协议", ErrBadHandshake)
+	}
+	if len(subprotocols) == 1 {
+		if !containsString(d.Subprotocols, subprotocols[0]) {
+			return fmt.Errorf("%w: 服务端响应了未请求的子协议%s", ErrBadHandshake, subprotocols[0])
+		}
+		wc.subprotocol = subprotocols[0]
+	}
+
+	//服务端只能响应客户端请求过的扩展
+	negotiated, err := confirmExtensions(parseExtensions(resp.Header), exts)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadHandshake, err)
+	}
+	wc.extensions = negotiated
+
+	return nil
+}
+
+// extensions 请求的扩展，压缩等级不为 NoCompression 时优先请求 permessage-deflate
+func (d *Dialer) extensions() []Extension {
+	if d.CompressLevel == NoCompression {
+		return d.Extensions
+	}
+	return append([]Extension{NewPermessageDeflate(d.CompressLevel)}, d.Extensions...)
+}
+
+// hostPortNoPort 返回带端口和不带端口的host，url中没有端口时按scheme补全默认端口
+func hostPortNoPort(u *url.URL) (hostPort, hostNoPort string) {
+	hostPort = u.Host
+	hostNoPort = u.Hostname()
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		hostPort = net.JoinHostPort(hostNoPort, port)
+	}
+	return
+}
@@ -0,0 +1,231 @@
+package mini_websocket
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRawHandshakeServer 劫持握手请求，按resp返回的原始响应回复，用于构造错误的握手响应
+func newRawHandshakeServer(t *testing.T, resp func(key string) string) string {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nc, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer nc.Close()
+		_, _ = brw.WriteString(resp(r.Header.Get("Sec-WebSocket-Key")))
+		_ = brw.Flush()
+		//等待客户端读完响应后断开
+		_, _ = brw.ReadByte()
+	}))
+	t.Cleanup(s.Close)
+	return wsURL(s)
+}
+
+func TestDialEcho(t *testing.T) {
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		if !c.IsServer {
+			t.Error("upgraded conn is not a server conn")
+		}
+		for {
+			mt, p, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = sendDataFrame(c, p, mt); err != nil {
+				return
+			}
+		}
+	})
+
+	c := dialTest(t, s, nil)
+	if c.IsServer {
+		t.Fatal("dialed conn is a server conn")
+	}
+	//服务端只接受带掩码的帧，能收到回复说明客户端的帧都做了掩码
+	for _, p := range []string{"hello", "", strings.Repeat("big", shardSize)} {
+		if err := c.SendMessage(p); err != nil {
+			t.Fatal(err)
+		}
+		mt, got, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mt != TextFrame || string(got) != p {
+			t.Fatalf("got %v %d bytes, want %d bytes", mt, len(got), len(p))
+		}
+	}
+}
+
+func TestDialBadHandshake(t *testing.T) {
+	const upgrade = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"
+	tests := []struct {
+		name string
+		resp func(key string) string
+	}{
+		{"not 101", func(key string) string {
+			return "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+		}},
+		{"accept mismatch", func(key string) string {
+			return upgrade + "Sec-WebSocket-Accept: " + EncodeSWK(GenerateSWK()) + "\r\n\r\n"
+		}},
+		{"missing accept", func(key string) string {
+			return upgrade + "\r\n"
+		}},
+		{"missing upgrade", func(key string) string {
+			return "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + EncodeSWK(key) + "\r\n\r\n"
+		}},
+		{"missing connection", func(key string) string {
+			return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: " + EncodeSWK(key) + "\r\n\r\n"
+		}},
+		{"unrequested extension", func(key string) string {
+			return upgrade + "Sec-WebSocket-Accept: " + EncodeSWK(key) + "\r\nSec-WebSocket-Extensions: permessage-deflate\r\n\r\n"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := newRawHandshakeServer(t, tt.resp)
+			c, err := DefaultDialer.Dial(context.Background(), url, nil)
+			if !errors.Is(err, ErrBadHandshake) {
+				t.Fatalf("err = %v, want ErrBadHandshake", err)
+			}
+			if c != nil {
+				t.Fatal("got a conn from a failed handshake")
+			}
+		})
+	}
+}
+
+func TestDialBadScheme(t *testing.T) {
+	for _, u := range []string{"http://example.com", "ftp://example.com", "example.com"} {
+		if _, err := DefaultDialer.Dial(context.Background(), u, nil); err != ErrBadScheme {
+			t.Fatalf("%s: err = %v, want ErrBadScheme", u, err)
+		}
+	}
+}
+
+func TestUpGradeRejects(t *testing.T) {
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		t.Error("bad request was upgraded")
+	})
+
+	valid := func() http.Header {
+		return http.Header{
+			"Connection":            {"Upgrade"},
+			"Upgrade":               {"websocket"},
+			"Sec-Websocket-Version": {"13"},
+			"Sec-Websocket-Key":     {GenerateSWK()},
+		}
+	}
+	tests := []struct {
+		name   string
+		method string
+		edit   func(h http.Header)
+		status int
+	}{
+		{"no connection upgrade", http.MethodGet, func(h http.Header) { h.Del("Connection") }, http.StatusBadRequest},
+		{"no upgrade", http.MethodGet, func(h http.Header) { h.Set("Upgrade", "h2c") }, http.StatusBadRequest},
+		{"post", http.MethodPost, func(h http.Header) {}, http.StatusMethodNotAllowed},
+		{"old version", http.MethodGet, func(h http.Header) { h.Set("Sec-Websocket-Version", "8") }, http.StatusUpgradeRequired},
+		{"bad key", http.MethodGet, func(h http.Header) { h.Set("Sec-Websocket-Key", "short") }, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, s.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header = valid()
+			tt.edit(req.Header)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+// TestUpGradeAcceptKey 101响应的 Sec-WebSocket-Accept 按RFC 6455 1.3的示例计算
+func TestUpGradeAcceptKey(t *testing.T) {
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {})
+
+	nc, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	_, err = nc.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(nc), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("accept = %q", got)
+	}
+}
+
+// TestDialHandshakeTimeout 服务端不回复时，超过 HandshakeTimeout 返回 ErrHandshakeTimeout；ctx先结束时返回 ctx.Err()
+func TestDialHandshakeTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		ctx     time.Duration
+		err     error
+	}{
+		{"handshake timeout", 100 * time.Millisecond, 0, ErrHandshakeTimeout},
+		{"ctx first", 5 * time.Second, 100 * time.Millisecond, context.DeadlineExceeded},
+		{"timeout first", 100 * time.Millisecond, 5 * time.Second, ErrHandshakeTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := newSilentListener(t)
+			ctx := context.Background()
+			if tt.ctx > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.ctx)
+				defer cancel()
+			}
+
+			start := time.Now()
+			_, err := (&Dialer{HandshakeTimeout: tt.timeout}).Dial(ctx, url, nil)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if d := time.Since(start); d > 2*time.Second {
+				t.Fatalf("dial returned after %v", d)
+			}
+		})
+	}
+}
+
+func TestNewUpGraderHandshakeTimeout(t *testing.T) {
+	for _, tt := range []struct{ in, want time.Duration }{
+		{0, minHandshakeTimeout},
+		{time.Millisecond, minHandshakeTimeout},
+		{3 * time.Second, 3 * time.Second},
+	} {
+		if ug := NewUpGrader(tt.in, 0, 0, nil, nil, 0); ug.HandshakeTimeout != tt.want {
+			t.Fatalf("NewUpGrader(%v).HandshakeTimeout = %v, want %v", tt.in, ug.HandshakeTimeout, tt.want)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultEventLoopReadTimeout = 5 * time.Second //事件循环里不完整的消息默认的最长等待时间
+
+var (
+	ErrEventLoopUnsupported = errors.New("当前平台不支持事件循环模式")
+	ErrEventLoopReadTimeout = errors.New("连接没有在 ReadTimeout 内发完一条消息")
+
+	errEventLoopConn   = errors.New("事件循环只支持能取得文件描述符的连接，如 *net.TCPConn")
+	errEventLoopClosed = errors.New("事件循环已关闭")
+
+	//事件循环模式下，处理完控制帧后缓冲区里没有完整的消息，等待下一次可读事件
+	errPollIdle = errors.New("没有可读的数据")
+)
+
+// EventLoop 事件循环模式：连接可读时才由少量的工作协程读取并处理消息，空闲的连接不占用协程和读写缓冲区，
+// 适合大量空闲的长连接。只支持 Linux（epoll），其他平台 NewEventLoop 返回 ErrEventLoopUnsupported。
+// 工作协程只读取已经到达的数据，不会阻塞在网络读取上：数据凑够一条完整的消息才交给 OnMessage，
+// 不完整的消息暂存在缓冲区里，等待下一次可读事件。
+// 加入事件循环的连接不能再由其他协程读取，发送方法可以照常使用，发送时从池里借用写缓冲区
+type EventLoop struct {
+	//收到一条text或binary消息时调用，在工作协程里执行，耗时的处理应交给其他协程；应在加入连接前设置
+	OnMessage func(wc *WsConn, mt MessageType, payload []byte)
+	//连接关闭后调用，err为读取时遇到的错误，由其他方式关闭时为nil；应在加入连接前设置
+	OnClose func(wc *WsConn, err error)
+	//收到一条消息的开头后，剩余部分需要在该时间内到达，否则以 ErrEventLoopReadTimeout 关闭连接，
+	//每条消息单独计时，避免只发半个帧的连接长期占用缓冲区；为0时使用默认的5秒，应在加入连接前设置
+	ReadTimeout time.Duration
+
+	poller *poller
+	jobs   chan *pollConn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	conns map[int]*pollConn
+}
+
+// pollConn 加入事件循环的连接，serving、closed、err 受 EventLoop.mu 保护；
+// pending、src、timer 只在处理该连接的工作协程里访问
+type pollConn struct {
+	wc         *WsConn
+	fd         int
+	rc         syscall.RawConn
+	registered bool  //已加入epoll，握手后读缓冲区里还有数据时先处理再加入
+	serving    bool  //正在被工作协程处理
+	closed     bool  //底层连接已关闭
+	err        error //关闭连接的原因
+
+	pending *bytes.Buffer //已经读到、还没有处理的数据，为空时归还
+	src     bytes.Reader  //处理时 WsConn.BufRD 从这里读取 pending 里的数据
+	timer   *time.Timer   //pending 里的不完整消息的超时
+}
+
+// NewEventLoop workers 为处理消息的工作协程数，不大于0时为1。
+// 工作协程不会因为连接只发了半条消息而阻塞，但 OnMessage 的执行时间（包括在里面向慢连接发送）会占用工作协程，
+// 所有工作协程都忙时，可读事件的分发也会等待；OnMessage 可能阻塞时应多开工作协程，或把处理交给其他协程
+func NewEventLoop(workers int) (*EventLoop, error) {
+	if workers <= 0 {
+		workers = 1
+	}
+	p, err := newPoller()
+	if err != nil {
+		return nil, err
+	}
+
+	el := &EventLoop{
+		poller: p,
+		jobs:   make(chan *pollConn, workers),
+		conns:  make(map[int]*pollConn),
+	}
+	el.ctx, el.cancel = context.WithCancel(context.Background())
+
+	go el.poll()
+	for i := 0; i < workers; i++ {
+		go el.work()
+	}
+	return el, nil
+}
+
+// Add 把升级完成的连接加入事件循环，之后连接的消息通过 OnMessage 交给应用处理。
+// 连接原有的读写缓冲区会被释放
+func (el *EventLoop) Add(wc *WsConn) error {
+	sc, ok := wc.Conn.(syscall.Conn)
+	if !ok {
+		return errEventLoopConn
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	fd := -1
+	if err = rc.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		return err
+	}
+
+	pc := &pollConn{wc: wc, fd: fd, rc: rc}
+	//握手后紧跟的帧可能还在读缓冲区里，转存下来先处理
+	if wc.BufRD != nil && wc.BufRD.Buffered() > 0 {
+		p, _ := wc.BufRD.Peek(wc.BufRD.Buffered())
+		pc.pending = getBuffer()
+		pc.pending.Write(p)
+	}
+	wc.BufRD = nil
+	pending := pc.pending != nil
+	pc.registered = !pending
+
+	//写缓冲区在握手时已经刷新，之后发送时再借用
+	wc.writeMu.Lock()
+	wc.BufWR = nil
+	wc.poll = pc
+	wc.writeMu.Unlock()
+
+	el.mu.Lock()
+	if el.ctx.Err() != nil {
+		el.mu.Unlock()
+		return errEventLoopClosed
+	}
+	if !pending {
+		if err = el.poller.add(fd); err != nil {
+			el.mu.Unlock()
+			return err
+		}
+	}
+	el.conns[fd] = pc
+	el.mu.Unlock()
+
+	wc.onClose(func() { el.remove(pc) })
+	if pending {
+		el.submit(pc)
+	}
+	return nil
+}
+
+// Len 事件循环里的连接数
+func (el *EventLoop) Len() int {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	return len(el.conns)
+}
+
+// Close 停止事件循环，并关闭所有加入的连接
+func (el *EventLoop) Close() error {
+	el.mu.Lock()
+	if el.ctx.Err() != nil {
+		el.mu.Unlock()
+		return errEventLoopClosed
+	}
+	el.cancel()
+	conns := make([]*pollConn, 0, len(el.conns))
+	for _, pc := range el.conns {
+		conns = append(conns, pc)
+	}
+	el.mu.Unlock()
+
+	err := el.poller.wakeup()
+	for _, pc := range conns {
+		_ = closeTcp(pc.wc)
+	}
+	return err
+}
+
+// poll 等待可读事件，交给工作协程处理
+func (el *EventLoop) poll() {
+	err := el.poller.wait(func(fd int) {
+		el.mu.Lock()
+		pc, ok := el.conns[fd]
+		el.mu.Unlock()
+		if ok {
+			el.submit(pc)
+		}
+	})
+	//epoll出错时无法继续工作，关闭所有连接，应用通过 OnClose 得知
+	if err != nil && el.ctx.Err() == nil {
+		_ = el.Close()
+	}
+
+	//工作协程在锁内重新监听，关闭后不能再使用epoll的文件描述符
+	el.mu.Lock()
+	_ = el.poller.close()
+	el.mu.Unlock()
+}
+
+func (el *EventLoop) submit(pc *pollConn) {
+	select {
+	case el.jobs <- pc:
+	case <-el.ctx.Done():
+	}
+}
+
+func (el *EventLoop) work() {
+	for {
+		select {
+		case <-el.ctx.Done():
+			return
+		case pc := <-el.jobs:
+			el.serve(pc)
+		}
+	}
+}
+
+// serve 读取连接里已经到达的数据，处理其中所有完整的消息，之后重新监听可读事件
+func (el *EventLoop) serve(pc *pollConn) {
+	el.mu.Lock()
+	if pc.closed {
+		el.mu.Unlock()
+		return
+	}
+	pc.serving = true
+	el.mu.Unlock()
+
+	wc := pc.wc
+	readErr := pc.fill()
+	if readErr == nil && pc.ready() {
+		pc.src.Reset(pc.pending.Bytes())
+		wc.BufRD = getReader(&pc.src)
+		for pc.ready() {
+			mt, payload, err := wc.ReadMessage()
+			if err == errPollIdle {
+				break
+			}
+			if err != nil {
+				readErr = err
+				break
+			}
+			if el.OnMessage != nil {
+				el.OnMessage(wc, mt, payload)
+			}
+		}
+		//丢弃已经处理的部分，剩下不完整的消息
+		consumed := pc.pending.Len() - len(pc.unread())
+		pc.pending.Next(consumed)
+		putReader(wc.BufRD)
+		wc.BufRD = nil
+		//处理掉了数据说明之前计时的消息已经完整，剩下的是新的消息，重新计时
+		if consumed > 0 && pc.timer != nil {
+			pc.timer.Stop()
+			pc.timer = nil
+		}
+	}
+	if readErr != nil {
+		_ = closeTcp(wc)
+	} else {
+		el.watchPending(pc)
+	}
+
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	pc.serving = false
+	if readErr != nil && pc.err == nil {
+		pc.err = readErr
+	}
+	if pc.closed {
+		//处理期间连接被关闭，由工作协程通知应用
+		el.closed(pc)
+		return
+	}
+	if el.ctx.Err() != nil {
+		return
+	}
+	var err error
+	if pc.registered {
+		err = el.poller.rearm(pc.fd)
+	} else {
+		err = el.poller.add(pc.fd)
+		pc.registered = err == nil
+	}
+	if err != nil {
+		wc.logger.warn("EventLoop.serve failed to watch conn", "err", err)
+		go closeTcp(wc)
+	}
+}
+
+// watchPending 没有暂存的数据时归还缓冲区；有不完整的消息时从消息开始到达时计时，超时后关闭连接
+func (el *EventLoop) watchPending(pc *pollConn) {
+	if pc.pending.Len() == 0 {
+		putBuffer(pc.pending)
+		pc.pending = nil
+		if pc.timer != nil {
+			pc.timer.Stop()
+			pc.timer = nil
+		}
+		return
+	}
+	if pc.timer != nil {
+		return
+	}
+
+	timeout := el.ReadTimeout
+	if timeout <= 0 {
+		timeout = defaultEventLoopReadTimeout
+	}
+	pc.timer = time.AfterFunc(timeout, func() {
+		el.mu.Lock()
+		if pc.err == nil {
+			pc.err = ErrEventLoopReadTimeout
+		}
+		el.mu.Unlock()
+		_ = closeTcp(pc.wc)
+	})
+}
+
+// fill 不阻塞地读出连接里已经到达的数据，追加到 pending，每次最多读取一个分片
+func (pc *pollConn) fill() error {
+	if pc.pending == nil {
+		pc.pending = getBuffer()
+	}
+	shard := getShard()
+	defer putShard(shard)
+
+	n, err := readAvailable(pc.rc, (*shard)[:shardSize])
+	pc.pending.Write((*shard)[:n])
+	if err == io.EOF {
+		//未收到关闭帧连接就断开了
+		err = &CloseError{Code: CloseAbnormal, Reason: err.Error()}
+	}
+	return err
+}
+
+// unread pending 里还没有被 WsConn.BufRD 读走的部分
+func (pc *pollConn) unread() []byte {
+	if pc.pending == nil {
+		return nil
+	}
+	b := pc.pending.Bytes()
+	if br := pc.wc.BufRD; br != nil {
+		b = b[len(b)-br.Buffered()-pc.src.Len():]
+	}
+	return b
+}
+
+// ready 未处理的数据里是否有可以不阻塞地处理完的内容
+func (pc *pollConn) ready() bool {
+	return messageReady(pc.unread(), pc.wc.readLimit)
+}
+
+// messageReady 按帧头部判断b的开头是否是完整的控制帧或者完整的数据消息（包括夹在分片之间的控制帧）。
+// 头部声明的长度超过读取限制、或者控制帧过长时也返回true，交给读取方法按协议错误处理
+func messageReady(b []byte, readLimit int64) bool {
+	var total uint64
+	started := false //已经读到消息的第一个数据帧，第一个分片的负载可能为空，不能用 total 判断
+	for {
+		if len(b) < 2 {
+			return false
+		}
+		opcode, fin := MessageType(b[0]&0x0f), b[0]&0x80 != 0
+		header, length := 2, uint64(b[1]&0x7f)
+		switch length {
+		case 126:
+			header += 2
+		case 127:
+			header += 8
+		}
+		if b[1]&0x80 != 0 {
+			header += 4
+		}
+		if len(b) < header {
+			return false
+		}
+		switch length {
+		case 126:
+			length = uint64(b[2])<<8 | uint64(b[3])
+		case 127:
+			length = 0
+			for _, c := range b[2:10] {
+				length = length<<8 | uint64(c)
+			}
+		}
+
+		control := isControlOpCode(opcode)
+		if control && length > 125 {
+			return true
+		}
+		if !control {
+			started = true
+			total += length
+			if readLimit > 0 && total > uint64(readLimit) {
+				return true
+			}
+		}
+		if uint64(len(b)-header) < length {
+			return false
+		}
+		//消息开头的控制帧可以单独处理，分片之间的控制帧需要等到消息的最后一个帧
+		if (control && !started) || (!control && fin) {
+			return true
+		}
+		b = b[header+int(length):]
+	}
+}
+
+// remove 连接关闭后移出事件循环，关闭文件描述符时内核已经把它移出了epoll。
+// 在 closeTcp 里回调，正在被工作协程处理的连接由工作协程通知应用
+func (el *EventLoop) remove(pc *pollConn) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	//文件描述符可能已经被新的连接复用
+	if el.conns[pc.fd] == pc {
+		delete(el.conns, pc.fd)
+	}
+	pc.closed = true
+	if !pc.serving {
+		el.closed(pc)
+	}
+}
+
+// closed 释放暂存的数据，在新的协程里调用 OnClose，回调里可以调用连接的任何方法。
+// 调用方持有 EventLoop.mu，此时没有工作协程在处理该连接
+func (el *EventLoop) closed(pc *pollConn) {
+	if pc.timer != nil {
+		pc.timer.Stop()
+		pc.timer = nil
+	}
+	putBuffer(pc.pending)
+	pc.pending = nil
+
+	if el.OnClose != nil {
+		go el.OnClose(pc.wc, pc.err)
+	}
+}
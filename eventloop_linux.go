@@ -0,0 +1,103 @@
+// @author cold bin
+// @date 2026/10/16
+
+//go:build linux
+// +build linux
+
+package mini_websocket
+
+import (
+	"io"
+	"syscall"
+)
+
+// 监听可读和对端关闭，触发一次后需要重新监听，保证同一连接同一时刻只由一个工作协程处理
+const pollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// poller 基于epoll的可读事件通知，wake 为唤醒 wait 的管道
+type poller struct {
+	epfd int
+	wake [2]int
+}
+
+func newPoller() (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	p := &poller{epfd: epfd}
+	if err = syscall.Pipe2(p.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		_ = syscall.Close(epfd)
+		return nil, err
+	}
+
+	ev := &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(p.wake[0])}
+	if err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, p.wake[0], ev); err != nil {
+		_ = p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *poller) add(fd int) error {
+	ev := &syscall.EpollEvent{Events: pollEvents, Fd: int32(fd)}
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, ev)
+}
+
+// rearm 处理完后重新监听
+func (p *poller) rearm(fd int) error {
+	ev := &syscall.EpollEvent{Events: pollEvents, Fd: int32(fd)}
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, fd, ev)
+}
+
+// wait 等待事件并回调，直到被 wakeup 唤醒或出错
+func (p *poller) wait(handler func(fd int)) error {
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return err
+		}
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == p.wake[0] {
+				return nil
+			}
+			handler(fd)
+		}
+	}
+}
+
+func (p *poller) wakeup() error {
+	_, err := syscall.Write(p.wake[1], []byte{0})
+	return err
+}
+
+func (p *poller) close() error {
+	_ = syscall.Close(p.wake[0])
+	_ = syscall.Close(p.wake[1])
+	return syscall.Close(p.epfd)
+}
+
+// readAvailable 读取内核缓冲区里已有的数据，没有数据时返回0，不等待
+func readAvailable(rc syscall.RawConn, p []byte) (n int, err error) {
+	cerr := rc.Read(func(fd uintptr) bool {
+		n, err = syscall.Read(int(fd), p)
+		return true
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	switch {
+	case err == syscall.EAGAIN || err == syscall.EINTR:
+		return 0, nil
+	case err != nil:
+		return 0, err
+	case n == 0 && len(p) > 0:
+		return 0, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,40 @@
+// @author cold bin
+// @date 2026/10/16
+
+//go:build !linux
+// +build !linux
+
+package mini_websocket
+
+import "syscall"
+
+// poller 非Linux平台不支持事件循环模式
+type poller struct{}
+
+func newPoller() (*poller, error) {
+	return nil, ErrEventLoopUnsupported
+}
+
+func (p *poller) add(fd int) error {
+	return ErrEventLoopUnsupported
+}
+
+func (p *poller) rearm(fd int) error {
+	return ErrEventLoopUnsupported
+}
+
+func (p *poller) wait(handler func(fd int)) error {
+	return ErrEventLoopUnsupported
+}
+
+func (p *poller) wakeup() error {
+	return ErrEventLoopUnsupported
+}
+
+func (p *poller) close() error {
+	return ErrEventLoopUnsupported
+}
+
+func readAvailable(rc syscall.RawConn, p []byte) (int, error) {
+	return 0, ErrEventLoopUnsupported
+}
@@ -0,0 +1,370 @@
+//go:build linux
+// +build linux
+
+package mini_websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// closeEvent OnClose 收到的参数
+type closeEvent struct {
+	wc  *WsConn
+	err error
+}
+
+// newEchoLoop 把 OnMessage 收到的消息原样发回的事件循环，以及把升级后的连接加入其中的测试服务器
+func newEchoLoop(t *testing.T, workers int, readTimeout time.Duration) (*EventLoop, chan closeEvent, string) {
+	t.Helper()
+	el, err := NewEventLoop(workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = el.Close() })
+
+	closed := make(chan closeEvent, 16)
+	el.ReadTimeout = readTimeout
+	el.OnMessage = func(wc *WsConn, mt MessageType, payload []byte) {
+		if err := sendDataFrame(wc, payload, mt); err != nil {
+			t.Error(err)
+		}
+	}
+	el.OnClose = func(wc *WsConn, err error) { closed <- closeEvent{wc, err} }
+
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		if err := el.Add(c); err != nil {
+			t.Error(err)
+		}
+	})
+	return el, closed, wsURL(s)
+}
+
+func dialLoop(t *testing.T, url string) *WsConn {
+	t.Helper()
+	c, err := DefaultDialer.Dial(context.Background(), url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = closeTcp(c) })
+	return c
+}
+
+func expectEcho(t *testing.T, c *WsConn, mt MessageType, p []byte) {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	gotMt, got, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotMt != mt || !bytes.Equal(got, p) {
+		t.Fatalf("got %v %d bytes, want %v %d bytes", gotMt, len(got), mt, len(p))
+	}
+}
+
+func TestEventLoopEcho(t *testing.T) {
+	el, _, url := newEchoLoop(t, 2, 0)
+	c := dialLoop(t, url)
+
+	var pongs int
+	c.SetPongHandler(func([]byte) error {
+		pongs++
+		return nil
+	})
+
+	tests := []struct {
+		name string
+		mt   MessageType
+		p    []byte
+	}{
+		{"text", TextFrame, []byte("hello")},
+		{"empty", BinaryFrame, []byte{}},
+		{"fragmented", BinaryFrame, bytes.Repeat([]byte("x"), 3*shardSize+5)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := sendDataFrame(c, tt.p, tt.mt); err != nil {
+				t.Fatal(err)
+			}
+			expectEcho(t, c, tt.mt, tt.p)
+		})
+	}
+
+	//只有ping时回复pong，不会交给 OnMessage
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendMessage("after ping"); err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, c, TextFrame, []byte("after ping"))
+	if pongs != 1 {
+		t.Fatalf("pongs = %d, want 1", pongs)
+	}
+	if n := el.Len(); n != 1 {
+		t.Fatalf("Len = %d, want 1", n)
+	}
+}
+
+// TestEventLoopPingBetweenFragments 分片之间的ping要等到消息的最后一个分片到达后一起处理
+func TestEventLoopPingBetweenFragments(t *testing.T) {
+	_, _, url := newEchoLoop(t, 1, 0)
+	c := dialLoop(t, url)
+
+	writeRaw(t, c, rawFrame(TextFrame, false, 0, true, []byte("hel")))
+	writeRaw(t, c, rawFrame(PingFrame, true, 0, true, nil))
+	time.Sleep(50 * time.Millisecond)
+	writeRaw(t, c, rawFrame(ContinuationFrame, true, 0, true, []byte("lo")))
+	expectEcho(t, c, TextFrame, []byte("hello"))
+
+	//第一个分片的负载为空时，后面的ping同样在分片之间
+	writeRaw(t, c, append(rawFrame(TextFrame, false, 0, true, nil), rawFrame(PingFrame, true, 0, true, nil)...))
+	time.Sleep(50 * time.Millisecond)
+	writeRaw(t, c, rawFrame(ContinuationFrame, true, 0, true, []byte("lo")))
+	expectEcho(t, c, TextFrame, []byte("lo"))
+}
+
+// TestEventLoopEarlyFrames 客户端在握手请求后立即发送的帧已经在服务端的读缓冲区里，加入事件循环后应被处理
+func TestEventLoopEarlyFrames(t *testing.T) {
+	_, _, url := newEchoLoop(t, 1, 0)
+
+	nc, err := net.Dial("tcp", strings.TrimPrefix(url, "ws://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	req := "GET / HTTP/1.1\r\nHost: " + nc.RemoteAddr().String() + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	raw := append([]byte(req), rawFrame(TextFrame, true, 0, true, []byte("early"))...)
+	raw = append(raw, rawFrame(BinaryFrame, true, 0, true, []byte("bird"))...)
+	if _, err = nc.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	c := newWsConn(nc, false, br, 0, 0, 0)
+	expectEcho(t, c, TextFrame, []byte("early"))
+	expectEcho(t, c, BinaryFrame, []byte("bird"))
+}
+
+// TestEventLoopSlowloris 只发了半个帧的连接不占用工作协程，其他连接照常处理，超时后被关闭
+func TestEventLoopSlowloris(t *testing.T) {
+	const readTimeout = 300 * time.Millisecond
+	_, closed, url := newEchoLoop(t, 1, readTimeout)
+
+	slow := dialLoop(t, url)
+	frame := rawFrame(TextFrame, true, 0, true, []byte("never finished"))
+	writeRaw(t, slow, frame[:3])
+
+	//唯一的工作协程没有被慢连接阻塞
+	fast := dialLoop(t, url)
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		if err := fast.SendMessage("ping me"); err != nil {
+			t.Fatal(err)
+		}
+		expectEcho(t, fast, TextFrame, []byte("ping me"))
+		if d := time.Since(start); d > readTimeout/2 {
+			t.Fatalf("echo took %v while a peer was stalled", d)
+		}
+	}
+
+	select {
+	case ev := <-closed:
+		if !errors.Is(ev.err, ErrEventLoopReadTimeout) {
+			t.Fatalf("OnClose err = %v, want ErrEventLoopReadTimeout", ev.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled conn was not closed")
+	}
+
+	//慢连接被关闭，快连接不受影响
+	_ = slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := slow.ReadMessage(); err == nil {
+		t.Fatal("stalled conn still open")
+	}
+	if err := fast.SendMessage("still here"); err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, fast, TextFrame, []byte("still here"))
+}
+
+// TestEventLoopSlowMessage 在 ReadTimeout 内陆续到达的消息照常处理
+func TestEventLoopSlowMessage(t *testing.T) {
+	_, _, url := newEchoLoop(t, 1, 2*time.Second)
+	c := dialLoop(t, url)
+
+	frame := rawFrame(BinaryFrame, true, 0, true, bytes.Repeat([]byte("z"), 1000))
+	for _, chunk := range [][]byte{frame[:1], frame[1:4], frame[4:500], frame[500:]} {
+		writeRaw(t, c, chunk)
+		time.Sleep(20 * time.Millisecond)
+	}
+	expectEcho(t, c, BinaryFrame, bytes.Repeat([]byte("z"), 1000))
+}
+
+// TestEventLoopMessagesInFlight 每次发送都把消息切开、总有一条消息没发完的连接，只要每条消息在 ReadTimeout 内发完就不会被关闭
+func TestEventLoopMessagesInFlight(t *testing.T) {
+	const readTimeout = 300 * time.Millisecond
+	_, closed, url := newEchoLoop(t, 1, readTimeout)
+	c := dialLoop(t, url)
+
+	//28字节的帧按17字节切分，每条消息跨越两次发送
+	const n = 12
+	var stream []byte
+	for i := 0; i < n; i++ {
+		stream = append(stream, rawFrame(TextFrame, true, 0, true, []byte(fmt.Sprintf("in-flight message #%03d", i)))...)
+	}
+	echoed := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, p, err := c.ReadMessage()
+			if err == nil && string(p) != fmt.Sprintf("in-flight message #%03d", i) {
+				err = fmt.Errorf("got %q", p)
+			}
+			if err != nil {
+				echoed <- err
+				return
+			}
+		}
+		echoed <- nil
+	}()
+	for len(stream) > 0 {
+		end := 17
+		if end > len(stream) {
+			end = len(stream)
+		}
+		writeRaw(t, c, stream[:end])
+		stream = stream[end:]
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := <-echoed; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-closed:
+		t.Fatalf("conn closed with %v while every message finished in time", ev.err)
+	default:
+	}
+}
+
+func TestEventLoopClose(t *testing.T) {
+	el, closed, url := newEchoLoop(t, 2, 0)
+
+	//对端正常关闭
+	c := dialLoop(t, url)
+	if err := c.SendMessage("hi"); err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, c, TextFrame, []byte("hi"))
+	if err := c.CloseRight(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-closed:
+		var ce *CloseError
+		if !errors.As(ev.err, &ce) || ce.Code != CloseRight {
+			t.Fatalf("OnClose err = %v, want close code %d", ev.err, CloseRight)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose not called")
+	}
+	waitLen(t, el, 0)
+
+	//关闭事件循环时关闭所有连接
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dialLoop(t, url)
+		}()
+	}
+	wg.Wait()
+	waitLen(t, el, 3)
+	if err := el.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("OnClose not called after Close")
+		}
+	}
+	if err := el.Close(); err != errEventLoopClosed {
+		t.Fatalf("second Close = %v", err)
+	}
+}
+
+// waitLen 等待事件循环里的连接数变为n
+func waitLen(t *testing.T, el *EventLoop, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for el.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Len = %d, want %d", el.Len(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMessageReady(t *testing.T) {
+	text := rawFrame(TextFrame, true, 0, true, []byte("hello"))
+	first := rawFrame(TextFrame, false, 0, true, []byte("hel"))
+	last := rawFrame(ContinuationFrame, true, 0, true, []byte("lo"))
+	emptyFirst := rawFrame(TextFrame, false, 0, true, nil)
+	ping := rawFrame(PingFrame, true, 0, true, nil)
+	big := rawFrame(BinaryFrame, true, 0, false, make([]byte, 70000))
+	join := func(bs ...[]byte) []byte { return bytes.Join(bs, nil) }
+
+	tests := []struct {
+		name  string
+		b     []byte
+		limit int64
+		want  bool
+	}{
+		{"empty", nil, 0, false},
+		{"one byte", text[:1], 0, false},
+		{"partial mask key", text[:4], 0, false},
+		{"partial payload", text[:len(text)-1], 0, false},
+		{"complete", text, 0, true},
+		{"ping", ping, 0, true},
+		{"first fragment", first, 0, false},
+		{"ping between fragments", join(first, ping), 0, false},
+		{"fragmented", join(first, ping, last), 0, true},
+		{"ping after empty first fragment", join(emptyFirst, ping), 0, false},
+		{"empty first fragment", join(emptyFirst, ping, last), 0, true},
+		{"partial 64-bit length", big[:6], 0, false},
+		{"partial big payload", big[:100], 0, false},
+		{"big payload over limit", big[:10], 1000, true},
+		{"fragments over limit", first, 2, true},
+		{"big control frame", rawFrame(PingFrame, true, 0, true, make([]byte, 126))[:8], 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := messageReady(tt.b, tt.limit); got != tt.want {
+				t.Fatalf("messageReady = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// 帧头部RSV位的掩码，按 RSV1、RSV2、RSV3 的顺序从高到低排列
+const (
+	RSV1Bit uint16 = 1 << 2
+	RSV2Bit uint16 = 1 << 1
+	RSV3Bit uint16 = 1
+)
+
+var (
+	errExtensionConflict = errors.New("扩展占用的rsv位或opcode冲突")
+	errExtensionOpCode   = errors.New("扩展只能占用保留的opcode：0x3~0x7、0xB~0xF")
+	errFrameRSVNotAccept = errors.New("frame 使用了未协商的rsv位")
+)
+
+// Extension 可以注册到 upGrader 和 Dialer 上的websocket扩展，
+// 负责 Sec-WebSocket-Extensions 的协商，协商成功后为每条连接生成一个 ExtensionConn
+type Extension interface {
+	// Name 扩展标识，如 "permessage-deflate"
+	Name() string
+	// Offer 客户端请求该扩展时的参数，如 "client_max_window_bits"，没有参数时返回空串
+	Offer() string
+	// Accept 服务端根据客户端请求的参数决定是否接受该扩展，接受时返回响应的参数
+	Accept(params map[string]string) (ec ExtensionConn, respParams string, ok bool)
+	// Confirm 客户端根据服务端响应的参数确认该扩展，参数不合法时返回错误
+	Confirm(params map[string]string) (ExtensionConn, error)
+}
+
+// ExtensionConn 协商成功后绑定在某条连接上的扩展
+type ExtensionConn interface {
+	// RSV 扩展占用的rsv位，由 RSV1Bit、RSV2Bit、RSV3Bit 组合而成
+	RSV() uint16
+	// OpCodes 扩展占用的保留opcode
+	OpCodes() []MessageType
+}
+
+// FrameTransformer 可选实现，逐帧变换数据；收到的帧已去掉掩码，发送的帧尚未掩码
+type FrameTransformer interface {
+	ReadFrame(frame *Frame) error
+	WriteFrame(frame *Frame) error
+}
+
+// MessageTransformer 可选实现，按消息变换负载
+type MessageTransformer interface {
+	// WrapWriter 包装一条消息负载的写入流，返回需要在消息第一个帧上设置的rsv位
+	WrapWriter(mt MessageType, w io.WriteCloser) (io.WriteCloser, uint16, error)
+	// WrapReader 包装一条消息负载的读取流，rsv为消息第一个帧上的rsv位
+	WrapReader(mt MessageType, rsv uint16, r io.Reader) (io.Reader, error)
+}
+
+// isReservedOpCode 是否为协议保留的opcode
+func isReservedOpCode(opcode MessageType) bool {
+	return (opcode >= 0x3 && opcode <= 0x7) || (opcode >= 0xB && opcode <= 0xF)
+}
+
+// isControlOpCode 是否为控制帧的opcode，控制帧的opcode最高位为1
+func isControlOpCode(opcode MessageType) bool {
+	return opcode&0x8 != 0
+}
+
+// extensionSet 校验并记录已协商扩展占用的rsv位和opcode
+type extensionSet struct {
+	conns   []ExtensionConn
+	rsv     uint16
+	opcodes map[MessageType]bool
+}
+
+func (es *extensionSet) add(ec ExtensionConn) error {
+	if es.rsv&ec.RSV() != 0 {
+		return errExtensionConflict
+	}
+	for _, opcode := range ec.OpCodes() {
+		if !isReservedOpCode(opcode) {
+			return errExtensionOpCode
+		}
+		if es.opcodes[opcode] {
+			return errExtensionConflict
+		}
+	}
+
+	if es.opcodes == nil {
+		es.opcodes = make(map[MessageType]bool)
+	}
+	for _, opcode := range ec.OpCodes() {
+		es.opcodes[opcode] = true
+	}
+	es.rsv |= ec.RSV()
+	es.conns = append(es.conns, ec)
+	return nil
+}
+
+// acceptExtensions 服务端按客户端请求的顺序协商扩展，同名扩展只接受第一个可接受的请求，
+// 返回协商成功的扩展和响应头 Sec-WebSocket-Extensions 的值
+func acceptExtensions(offers []extensionOffer, exts []Extension) (*extensionSet, string) {
+	es := new(extensionSet)
+	var resp []string
+	accepted := make(map[string]bool)
+
+	for _, offer := range offers {
+		if accepted[offer.name] {
+			continue
+		}
+		for _, ext := range exts {
+			if ext.Name() != offer.name {
+				continue
+			}
+			ec, respParams, ok := ext.Accept(offer.params)
+			if !ok || es.add(ec) != nil {
+				continue
+			}
+			accepted[offer.name] = true
+			if respParams != "" {
+				resp = append(resp, ext.Name()+"; "+respParams)
+			} else {
+				resp = append(resp, ext.Name())
+			}
+			break
+		}
+	}
+
+	return es, strings.Join(resp, ", ")
+}
+
+// offerExtensions 客户端请求头 Sec-WebSocket-Extensions 的值
+func offerExtensions(exts []Extension) string {
+	offers := make([]string, 0, len(exts))
+	for _, ext := range exts {
+		if params := ext.Offer(); params != "" {
+			offers = append(offers, ext.Name()+"; "+params)
+		} else {
+			offers = append(offers, ext.Name())
+		}
+	}
+	return strings.Join(offers, ", ")
+}
+
+// confirmExtensions 客户端确认服务端响应的扩展，服务端只能响应请求过的扩展
+func confirmExtensions(resps []extensionOffer, exts []Extension) (*extensionSet, error) {
+	es := new(extensionSet)
+	confirmed := make(map[string]bool)
+
+	for _, resp := range resps {
+		var ext Extension
+		for _, e := range exts {
+			if e.Name() == resp.name {
+				ext = e
+				break
+			}
+		}
+		if ext == nil || confirmed[resp.name] {
+			return nil, fmt.Errorf("服务端响应了未请求的扩展%s", resp.name)
+		}
+
+		ec, err := ext.Confirm(resp.params)
+		if err != nil {
+			return nil, err
+		}
+		if err = es.add(ec); err != nil {
+			return nil, err
+		}
+		confirmed[resp.name] = true
+	}
+
+	return es, nil
+}
+
+// claimedOpCode 该opcode是否被已协商的扩展占用
+func (wc *WsConn) claimedOpCode(opcode MessageType) bool {
+	return wc.extensions != nil && wc.extensions.opcodes[opcode]
+}
+
+// negotiatedRSV 已协商扩展占用的rsv位
+func (wc *WsConn) negotiatedRSV() uint16 {
+	if wc.extensions == nil {
+		return 0
+	}
+	return wc.extensions.rsv
+}
+
+// readFrameExtensions 收到帧后，逆序交给各扩展变换
+func (wc *WsConn) readFrameExtensions(frame *Frame) error {
+	if wc.extensions == nil {
+		return nil
+	}
+
+	for i := len(wc.extensions.conns) - 1; i >= 0; i-- {
+		if ft, ok := wc.extensions.conns[i].(FrameTransformer); ok {
+			if err := ft.ReadFrame(frame); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeFrameExtensions 发送帧前，按协商顺序交给各扩展变换，此时帧尚未掩码
+func (wc *WsConn) writeFrameExtensions(frame *Frame) error {
+	if wc.extensions == nil {
+		return nil
+	}
+	for _, ec := range wc.extensions.conns {
+		if ft, ok := ec.(FrameTransformer); ok {
+			if err := ft.WriteFrame(frame); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hasFrameTransformer 是否有扩展需要逐帧变换
+func (wc *WsConn) hasFrameTransformer() bool {
+	if wc.extensions == nil {
+		return false
+	}
+	for _, ec := range wc.extensions.conns {
+		if _, ok := ec.(FrameTransformer); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// wrapMessageWriter 包装消息的写入流，最先协商的扩展最先编码，返回消息第一个帧的rsv位
+func (wc *WsConn) wrapMessageWriter(mt MessageType, w io.WriteCloser) (io.WriteCloser, uint16, error) {
+	var rsv uint16
+	if wc.extensions == nil {
+		return w, rsv, nil
+	}
+	for i := len(wc.extensions.conns) - 1; i >= 0; i-- {
+		if mtf, ok := wc.extensions.conns[i].(MessageTransformer); ok {
+			var bits uint16
+			var err error
+			if w, bits, err = mtf.WrapWriter(mt, w); err != nil {
+				return nil, 0, err
+			}
+			rsv |= bits
+		}
+	}
+	return w, rsv, nil
+}
+
+// wrapMessageReader 逆序包装消息的读取流，最后协商的扩展最先解码
+func (wc *WsConn) wrapMessageReader(mt MessageType, rsv uint16, r io.Reader) (io.Reader, error) {
+	if wc.extensions == nil {
+		return r, nil
+	}
+	for i := len(wc.extensions.conns) - 1; i >= 0; i-- {
+		if mtf, ok := wc.extensions.conns[i].(MessageTransformer); ok {
+			var err error
+			if r, err = mtf.WrapReader(mt, rsv, r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
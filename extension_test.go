@@ -0,0 +1,186 @@
+package mini_websocket
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+const xorOpCode MessageType = 0x3
+
+// xorExt 测试用的扩展：占用RSV2和opcode 0x3，发送时把数据帧的负载逐字节取反并设置RSV2，收到时还原
+type xorExt struct{}
+
+func (xorExt) Name() string  { return "x-xor" }
+func (xorExt) Offer() string { return "" }
+
+func (xorExt) Accept(params map[string]string) (ExtensionConn, string, bool) {
+	return xorConn{}, "", true
+}
+
+func (xorExt) Confirm(params map[string]string) (ExtensionConn, error) {
+	return xorConn{}, nil
+}
+
+type xorConn struct{}
+
+func (xorConn) RSV() uint16            { return RSV2Bit }
+func (xorConn) OpCodes() []MessageType { return []MessageType{xorOpCode} }
+
+func (xorConn) ReadFrame(frame *Frame) error {
+	if isControlOpCode(MessageType(frame.OpCode)) {
+		return nil
+	}
+	if frame.RSV2 != 1 {
+		return errors.New("data frame without rsv2")
+	}
+	frame.SetRSV(frame.RSV() &^ RSV2Bit)
+	xorPayload(frame.Payload)
+	return nil
+}
+
+func (xorConn) WriteFrame(frame *Frame) error {
+	if isControlOpCode(MessageType(frame.OpCode)) {
+		return nil
+	}
+	frame.SetRSV(frame.RSV() | RSV2Bit)
+	xorPayload(frame.Payload)
+	return nil
+}
+
+func xorPayload(p []byte) {
+	for i := range p {
+		p[i] ^= 0xff
+	}
+}
+
+// TestExtensionNegotiated 协商成功的扩展逐帧变换负载，可以使用占用的rsv位和opcode
+func TestExtensionNegotiated(t *testing.T) {
+	ug := DefaultUpGrader
+	ug.Extensions = []Extension{xorExt{}}
+	s := newTestServer(t, &ug, func(c *WsConn, r *http.Request) {
+		for {
+			mt, p, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if mt == xorOpCode {
+				err = c.SendExtMessage(mt, p)
+			} else {
+				err = sendDataFrame(c, p, mt)
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+
+	c := dialTest(t, s, &Dialer{Extensions: []Extension{xorExt{}}})
+	if !c.claimedOpCode(xorOpCode) || c.negotiatedRSV() != RSV2Bit {
+		t.Fatal("x-xor not negotiated")
+	}
+
+	tests := []struct {
+		name string
+		mt   MessageType
+		p    []byte
+	}{
+		{"text", TextFrame, []byte("hello")},
+		{"fragmented", BinaryFrame, bytes.Repeat([]byte{1, 2, 3}, shardSize)},
+		{"extension opcode", xorOpCode, []byte("ext")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//扩展原地变换负载，发送副本
+			p := append([]byte(nil), tt.p...)
+			var err error
+			if tt.mt == xorOpCode {
+				err = c.SendExtMessage(tt.mt, p)
+			} else {
+				err = sendDataFrame(c, p, tt.mt)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			mt, got, err := c.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mt != tt.mt || !bytes.Equal(got, tt.p) {
+				t.Fatalf("got %v %d bytes, want %v %d bytes", mt, len(got), tt.mt, len(tt.p))
+			}
+		})
+	}
+}
+
+// TestExtensionNotNegotiated 没有协商的rsv位和保留opcode按协议错误以1002关闭
+func TestExtensionNotNegotiated(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"rsv1", rawFrame(TextFrame, true, RSV1Bit, true, []byte("a")), errFrameRSVNotAccept},
+		{"rsv2", rawFrame(TextFrame, true, RSV2Bit, true, []byte("a")), errFrameRSVNotAccept},
+		{"rsv3", rawFrame(BinaryFrame, true, RSV3Bit, true, []byte("a")), errFrameRSVNotAccept},
+		{"rsv on ping", rawFrame(PingFrame, true, RSV2Bit, true, nil), errFrameRSVNotAccept},
+		{"reserved data opcode", rawFrame(xorOpCode, true, 0, true, []byte("a")), errFrameOpCodeNotAccept},
+		{"reserved control opcode", rawFrame(0xB, true, 0, true, nil), errFrameOpCodeNotAccept},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errc := make(chan error, 1)
+			s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+				_, _, err := c.ReadMessage()
+				errc <- err
+			})
+			//客户端请求了扩展，服务端没有注册，协商不成功
+			c := dialTest(t, s, &Dialer{Extensions: []Extension{xorExt{}}})
+			if c.negotiatedRSV() != 0 {
+				t.Fatal("x-xor negotiated")
+			}
+			writeRaw(t, c, tt.frame)
+			if err := <-errc; !errors.Is(err, tt.err) {
+				t.Fatalf("server err = %v, want %v", err, tt.err)
+			}
+			expectCloseCode(t, c, CloseWrongProtocol)
+		})
+	}
+}
+
+func TestExtensionSetConflicts(t *testing.T) {
+	tests := []struct {
+		name  string
+		conns []ExtensionConn
+		err   error
+	}{
+		{"disjoint", []ExtensionConn{xorConn{}, newDeflateConn(true, BestSpeed, false, false)}, nil},
+		{"same rsv", []ExtensionConn{xorConn{}, xorConn{}}, errExtensionConflict},
+		{"same opcode", []ExtensionConn{xorConn{}, opcodeConn{xorOpCode}}, errExtensionConflict},
+		{"unreserved opcode", []ExtensionConn{opcodeConn{TextFrame}}, errExtensionOpCode},
+		{"control opcode", []ExtensionConn{opcodeConn{PingFrame}}, errExtensionOpCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			es := new(extensionSet)
+			var err error
+			for _, ec := range tt.conns {
+				if err = es.add(ec); err != nil {
+					break
+				}
+			}
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+// opcodeConn 只占用一个opcode的扩展
+type opcodeConn struct {
+	opcode MessageType
+}
+
+func (opcodeConn) RSV() uint16              { return 0 }
+func (c opcodeConn) OpCodes() []MessageType { return []MessageType{c.opcode} }
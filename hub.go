@@ -0,0 +1,171 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"context"
+	"sync"
+)
+
+const defaultHubQueueSize = 256 //Hub 每个连接默认的发送队列长度
+
+// Hub 连接注册表，向所有加入的连接广播消息。
+// 每个连接有独立的发送队列和发送协程，慢连接不会阻塞广播和其他连接；
+// 队列满了的连接会被移出 Hub 并直接关闭底层tcp连接，连接关闭后自动移出 Hub
+type Hub struct {
+	queueSize int
+
+	mu      sync.RWMutex
+	members map[*WsConn]*hubMember
+	hooked  map[*WsConn]bool //已注册关闭回调的连接，反复加入和移出时不重复注册
+}
+
+// NewHub queueSize 为每个连接的发送队列长度，不大于0时使用默认长度
+func NewHub(queueSize int) *Hub {
+	if queueSize <= 0 {
+		queueSize = defaultHubQueueSize
+	}
+	return &Hub{
+		queueSize: queueSize,
+		members:   make(map[*WsConn]*hubMember),
+		hooked:    make(map[*WsConn]bool),
+	}
+}
+
+// hubMember 加入 Hub 的连接和它的发送队列
+type hubMember struct {
+	wc     *WsConn
+	queue  chan *PreparedMessage
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Join 把连接加入 Hub，重复加入时什么都不做
+func (h *Hub) Join(wc *WsConn) {
+	h.mu.Lock()
+	if _, ok := h.members[wc]; ok {
+		h.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &hubMember{wc: wc, queue: make(chan *PreparedMessage, h.queueSize), ctx: ctx, cancel: cancel}
+	h.members[wc] = m
+	hook := !h.hooked[wc]
+	h.hooked[wc] = true
+	h.mu.Unlock()
+
+	go h.run(m)
+	if hook {
+		wc.onClose(func() { h.closed(wc) })
+	}
+}
+
+// Leave 把连接移出 Hub，队列里未发送的消息会被丢弃
+func (h *Hub) Leave(wc *WsConn) {
+	h.mu.Lock()
+	m, ok := h.members[wc]
+	delete(h.members, wc)
+	h.mu.Unlock()
+
+	if ok {
+		m.cancel()
+	}
+}
+
+// closed 连接关闭时移出 Hub，之后再加入需要重新注册关闭回调
+func (h *Hub) closed(wc *WsConn) {
+	h.mu.Lock()
+	delete(h.hooked, wc)
+	h.mu.Unlock()
+	h.Leave(wc)
+}
+
+// Len Hub 里的连接数
+func (h *Hub) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.members)
+}
+
+// Conns Hub 里所有连接的快照
+func (h *Hub) Conns() []*WsConn {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	conns := make([]*WsConn, 0, len(h.members))
+	for wc := range h.members {
+		conns = append(conns, wc)
+	}
+	return conns
+}
+
+// Broadcast 向 Hub 里的所有连接发送一条text或binary消息，只负责放入各连接的发送队列，不等待发送完成。
+// 消息以 PreparedMessage 的方式只编码一次，payload 会被复制，调用返回后可以复用
+func (h *Hub) Broadcast(mt MessageType, payload []byte) error {
+	pm, err := NewPreparedMessage(mt, payload)
+	if err != nil {
+		return err
+	}
+	h.BroadcastPrepared(pm)
+	return nil
+}
+
+// BroadcastPrepared 向 Hub 里的所有连接发送预编码的消息
+func (h *Hub) BroadcastPrepared(pm *PreparedMessage) {
+	h.dropSlow(h.enqueue(pm, nil))
+}
+
+// enqueue 把消息放入conns的发送队列，conns为nil时发给所有连接，不在 Hub 里的连接会被忽略；
+// 返回队列已满的慢连接
+func (h *Hub) enqueue(msg *PreparedMessage, conns []*WsConn) (slow []*WsConn) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	push := func(m *hubMember) {
+		select {
+		case m.queue <- msg:
+		default:
+			slow = append(slow, m.wc)
+		}
+	}
+
+	if conns == nil {
+		for _, m := range h.members {
+			push(m)
+		}
+		return slow
+	}
+	for _, wc := range conns {
+		if m, ok := h.members[wc]; ok {
+			push(m)
+		}
+	}
+	return slow
+}
+
+// dropSlow 慢连接可能阻塞在写上，发不出关闭帧，直接关闭底层tcp连接。
+// 关闭连接会触发 onClose 回调，调用方不能持有回调里需要的锁
+func (h *Hub) dropSlow(slow []*WsConn) {
+	for _, wc := range slow {
+		wc.logger.warn("Hub send queue is full, closing slow connection", "queueSize", h.queueSize)
+		h.Leave(wc)
+		_ = closeTcp(wc)
+	}
+}
+
+// run 连接的发送协程，发送失败时把连接移出 Hub
+func (h *Hub) run(m *hubMember) {
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case msg := <-m.queue:
+			if err := m.wc.WritePreparedMessage(msg); err != nil {
+				m.wc.logger.debug("Hub.run failed to send message, leaving hub", "err", err)
+				h.Leave(m.wc)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package mini_websocket
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// waitHubLen 等待 Hub 里的连接数变为n
+func waitHubLen(t *testing.T, h *Hub, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Len = %d, want %d", h.Len(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHubBroadcast(t *testing.T) {
+	h := NewHub(0)
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		h.Join(c)
+		h.Join(c)
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+
+	clients := make([]*WsConn, 3)
+	for i := range clients {
+		clients[i] = dialTest(t, s, nil)
+	}
+	waitHubLen(t, h, len(clients))
+
+	msgs := []struct {
+		mt MessageType
+		p  string
+	}{
+		{TextFrame, "hello"},
+		{BinaryFrame, string(incompressible(3 * shardSize))},
+		{TextFrame, "bye"},
+	}
+	for _, m := range msgs {
+		if err := h.Broadcast(m.mt, []byte(m.p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, c := range clients {
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for _, m := range msgs {
+			mt, p, err := c.ReadMessage()
+			if err != nil || mt != m.mt || string(p) != m.p {
+				t.Fatalf("client %d got %v %d bytes, %v", i, mt, len(p), err)
+			}
+		}
+	}
+
+	//关闭的连接自动移出 Hub
+	if err := clients[0].CloseRight(); err != nil {
+		t.Fatal(err)
+	}
+	waitHubLen(t, h, len(clients)-1)
+	if err := h.Broadcast(PingFrame, nil); err == nil {
+		t.Fatal("broadcast of a control frame succeeded")
+	}
+}
+
+// TestHubDropsSlowConn 发送队列满了的连接被移出 Hub 并关闭，不影响其他连接
+func TestHubDropsSlowConn(t *testing.T) {
+	h := NewHub(1)
+
+	//对端不读取，发送协程阻塞在写上
+	slowLocal, slowRemote := net.Pipe()
+	defer slowRemote.Close()
+	slow := NewWsConn(slowLocal, true, 0, 0, 0)
+
+	fastLocal, fastRemote := net.Pipe()
+	defer fastRemote.Close()
+	go func() { _, _ = io.Copy(ioutil.Discard, fastRemote) }()
+	fast := NewWsConn(fastLocal, true, 0, 0, 0)
+	defer closeTcp(fast)
+
+	h.Join(slow)
+	h.Join(fast)
+	for i := 0; i < 5; i++ {
+		if err := h.Broadcast(TextFrame, []byte("tick")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	waitHubLen(t, h, 1)
+	if conns := h.Conns(); len(conns) != 1 || conns[0] != fast {
+		t.Fatal("fast conn was dropped")
+	}
+	//慢连接的底层连接已经关闭
+	if _, err := slowRemote.Write([]byte{0}); err != io.ErrClosedPipe {
+		t.Fatalf("write to dropped conn = %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+// TestHubRejoinHooks 反复移出再加入 Hub，连接上的关闭回调不会越来越多，关闭后连接移出 Hub
+func TestHubRejoinHooks(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	wc := NewWsConn(local, true, 0, 0, 0)
+	hooks := func() int {
+		wc.hookMu.Lock()
+		defer wc.hookMu.Unlock()
+		return len(wc.closeHooks)
+	}
+
+	h := NewHub(0)
+	h.Join(wc)
+	for i := 0; i < 100; i++ {
+		h.Leave(wc)
+		h.Join(wc)
+	}
+	if n := hooks(); n != 1 {
+		t.Fatalf("close hooks = %d after rejoining, want 1", n)
+	}
+
+	_ = closeTcp(wc)
+	if h.Len() != 0 {
+		t.Fatalf("Len = %d after close", h.Len())
+	}
+	//关闭后再加入立即移出
+	h.Join(wc)
+	if h.Len() != 0 {
+		t.Fatalf("Len = %d after joining a closed conn", h.Len())
+	}
+}
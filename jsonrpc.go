@@ -0,0 +1,466 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const rpcVersion = "2.0"
+
+// JSON-RPC 2.0 预定义的错误码
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCInternalError  = -32603
+)
+
+var (
+	errRPCHandler = errors.New("rpc方法的签名应为 func(context.Context, P) (R, error) 或 func(context.Context, P) error")
+	errRPCBatch   = errors.New("批量调用不能为空")
+
+	ErrRPCStopped = errors.New("rpc连接已停止")
+
+	ctxType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// RPCError JSON-RPC 2.0 的错误对象。方法返回 *RPCError 时原样响应给调用方，
+// 返回其他错误时以 RPCInternalError 响应；调用方收到错误响应时 Call 返回 *RPCError
+type RPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("jsonrpc error %d: %s", e.Code, e.Message)
+}
+
+// rpcMessage 请求、通知和响应共用的消息结构：有 method 的是请求，其中没有 id 的是通知，没有 method 的是响应
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// RPCServer 注册的rpc方法，可以被多个 RPCConn 共用
+type RPCServer struct {
+	mu      sync.RWMutex
+	methods map[string]*rpcMethod
+}
+
+func NewRPCServer() *RPCServer {
+	return &RPCServer{methods: make(map[string]*rpcMethod)}
+}
+
+// rpcMethod 通过反射调用的方法，params 为参数的类型
+type rpcMethod struct {
+	fn        reflect.Value
+	params    reflect.Type
+	hasResult bool
+}
+
+// Register 注册方法，handler 的签名为 func(ctx context.Context, params P) (R, error) 或 func(ctx context.Context, params P) error，
+// 请求的 params 以JSON解码为P，R以JSON编码为响应的 result。ctx 在连接停止时取消，
+// 通过 RPCConnFromContext 可以取得所在的连接，向对端发起调用
+func (s *RPCServer) Register(method string, handler interface{}) error {
+	fn := reflect.ValueOf(handler)
+	t := fn.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.In(0) != ctxType ||
+		t.NumOut() < 1 || t.NumOut() > 2 || t.Out(t.NumOut()-1) != errType {
+		return errRPCHandler
+	}
+
+	s.mu.Lock()
+	s.methods[method] = &rpcMethod{fn: fn, params: t.In(1), hasResult: t.NumOut() == 2}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *RPCServer) method(name string) *rpcMethod {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.methods[name]
+}
+
+// call 解码参数并调用方法
+func (m *rpcMethod) call(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	isPtr := m.params.Kind() == reflect.Ptr
+	var pv reflect.Value
+	if isPtr {
+		pv = reflect.New(m.params.Elem())
+	} else {
+		pv = reflect.New(m.params)
+	}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, pv.Interface()); err != nil {
+			return nil, &RPCError{Code: RPCInvalidParams, Message: err.Error()}
+		}
+	}
+	if !isPtr {
+		pv = pv.Elem()
+	}
+
+	out := m.fn.Call([]reflect.Value{reflect.ValueOf(ctx), pv})
+	if err := out[len(out)-1]; !err.IsNil() {
+		return nil, err.Interface().(error)
+	}
+	if m.hasResult {
+		return out[0].Interface(), nil
+	}
+	return nil, nil
+}
+
+// RPCConn 以 WsConn 为传输的 JSON-RPC 2.0 连接。两端是对等的：都可以注册方法响应对端的调用，
+// 也都可以向对端发起调用，因此服务端可以调用客户端的方法。
+// 多个调用可以并发进行，共用一条连接，响应按 id 与调用匹配；收到的请求各自在新的协程里处理
+type RPCConn struct {
+	//调用的默认超时时间，ctx没有截止时间时生效，为0时不限制，应在使用前设置
+	CallTimeout time.Duration
+
+	wc     *WsConn
+	server *RPCServer
+	ctx    context.Context
+	cancel context.CancelFunc
+	nextID uint64
+
+	mu      sync.Mutex
+	pending map[uint64]chan *rpcMessage //等待响应的调用
+	err     error                       //Serve 停止的原因
+}
+
+type rpcConnKey struct{}
+
+// NewRPCConn server 为本端提供的方法，为nil时对端的调用都响应 RPCMethodNotFound。
+// 需要有协程调用 Serve 读取消息，调用才能收到响应
+func NewRPCConn(wc *WsConn, server *RPCServer) *RPCConn {
+	rc := &RPCConn{
+		wc:      wc,
+		server:  server,
+		pending: make(map[uint64]chan *rpcMessage),
+	}
+	rc.ctx, rc.cancel = context.WithCancel(context.WithValue(context.Background(), rpcConnKey{}, rc))
+	return rc
+}
+
+// RPCConnFromContext 方法的ctx所在的连接
+func RPCConnFromContext(ctx context.Context) *RPCConn {
+	rc, _ := ctx.Value(rpcConnKey{}).(*RPCConn)
+	return rc
+}
+
+// Conn 底层的 WsConn
+func (rc *RPCConn) Conn() *WsConn {
+	return rc.wc
+}
+
+// Serve 持续读取消息，处理对端的请求并把响应交给等待的调用，直到读取出错，返回读取的错误。
+// 返回后进行中的调用都返回该错误，正在处理的方法的ctx被取消
+func (rc *RPCConn) Serve() error {
+	for {
+		mt, r, err := rc.wc.NextReader()
+		if err != nil {
+			rc.stop(err)
+			return err
+		}
+		if mt != TextFrame && mt != BinaryFrame {
+			continue
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			rc.stop(err)
+			return err
+		}
+		rc.dispatch(data)
+	}
+}
+
+func (rc *RPCConn) stop(err error) {
+	rc.mu.Lock()
+	rc.err = err
+	rc.mu.Unlock()
+	rc.cancel()
+}
+
+// dispatch 处理一条消息，可能是单个请求或响应，也可能是批量的数组
+func (rc *RPCConn) dispatch(data []byte) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(data, &batch); err != nil {
+			rc.send(rpcErrorResponse(nil, RPCParseError, err.Error()))
+			return
+		}
+		if len(batch) == 0 {
+			rc.send(rpcErrorResponse(nil, RPCInvalidRequest, "empty batch"))
+			return
+		}
+		go rc.handleBatch(batch)
+		return
+	}
+
+	var msg rpcMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		rc.send(rpcErrorResponse(nil, RPCParseError, err.Error()))
+		return
+	}
+	if msg.Method == "" {
+		rc.deliver(&msg)
+		return
+	}
+	go func() {
+		if resp := rc.handle(&msg); resp != nil {
+			rc.send(resp)
+		}
+	}()
+}
+
+// handleBatch 并发处理批量消息里的请求，响应合并成一个数组发送；都是通知或响应时不发送
+func (rc *RPCConn) handleBatch(batch []json.RawMessage) {
+	resps := make([]*rpcMessage, len(batch))
+	var wg sync.WaitGroup
+	for i, raw := range batch {
+		var msg rpcMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			resps[i] = rpcErrorResponse(nil, RPCInvalidRequest, err.Error())
+			continue
+		}
+		if msg.Method == "" {
+			rc.deliver(&msg)
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, msg *rpcMessage) {
+			defer wg.Done()
+			resps[i] = rc.handle(msg)
+		}(i, &msg)
+	}
+	wg.Wait()
+
+	var out []*rpcMessage
+	for _, resp := range resps {
+		if resp != nil {
+			out = append(out, resp)
+		}
+	}
+	if len(out) > 0 {
+		rc.send(out)
+	}
+}
+
+// handle 调用请求的方法，返回响应，通知返回nil
+func (rc *RPCConn) handle(msg *rpcMessage) (resp *rpcMessage) {
+	notify := len(msg.ID) == 0
+	if msg.JSONRPC != rpcVersion {
+		if notify {
+			return nil
+		}
+		return rpcErrorResponse(msg.ID, RPCInvalidRequest, "jsonrpc must be "+rpcVersion)
+	}
+
+	m := rc.server.method(msg.Method)
+	if m == nil {
+		if notify {
+			return nil
+		}
+		return rpcErrorResponse(msg.ID, RPCMethodNotFound, "method not found: "+msg.Method)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			rc.wc.logger.error("RPCConn.handle method panicked", "method", msg.Method, "panic", p)
+			resp = nil
+			if !notify {
+				resp = rpcErrorResponse(msg.ID, RPCInternalError, fmt.Sprint(p))
+			}
+		}
+	}()
+
+	result, err := m.call(rc.ctx, msg.Params)
+	if notify {
+		return nil
+	}
+	if err != nil {
+		var re *RPCError
+		if !errors.As(err, &re) {
+			re = &RPCError{Code: RPCInternalError, Message: err.Error()}
+		}
+		return &rpcMessage{JSONRPC: rpcVersion, ID: msg.ID, Error: re}
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return rpcErrorResponse(msg.ID, RPCInternalError, err.Error())
+	}
+	return &rpcMessage{JSONRPC: rpcVersion, ID: msg.ID, Result: data}
+}
+
+func rpcErrorResponse(id json.RawMessage, code int, message string) *rpcMessage {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &rpcMessage{JSONRPC: rpcVersion, ID: id, Error: &RPCError{Code: code, Message: message}}
+}
+
+// deliver 把响应交给等待的调用，没有对应的调用时丢弃
+func (rc *RPCConn) deliver(msg *rpcMessage) {
+	id, err := strconv.ParseUint(string(msg.ID), 10, 64)
+	if err != nil {
+		rc.wc.logger.warn("RPCConn.deliver got response with unknown id", "id", string(msg.ID), "rpcError", msg.Error)
+		return
+	}
+
+	rc.mu.Lock()
+	ch, ok := rc.pending[id]
+	delete(rc.pending, id)
+	rc.mu.Unlock()
+
+	if ok {
+		ch <- msg
+	}
+}
+
+func (rc *RPCConn) send(v interface{}) {
+	if err := rc.wc.WriteJSON(v); err != nil {
+		rc.wc.logger.debug("RPCConn.send failed to write message", "err", err)
+	}
+}
+
+// Call 调用对端的方法，params 以JSON编码为请求的 params，为nil时不发送；响应的 result 解码到result，result为nil时忽略。
+// 对端返回错误响应时返回 *RPCError；ctx结束或超过 CallTimeout 时返回 ctx 的错误，之后到达的响应会被丢弃
+func (rc *RPCConn) Call(ctx context.Context, method string, params, result interface{}) error {
+	call := &RPCCall{Method: method, Params: params, Result: result}
+	if err := rc.Batch(ctx, []*RPCCall{call}); err != nil {
+		return err
+	}
+	return call.Error
+}
+
+// Notify 向对端发送通知，不等待响应
+func (rc *RPCConn) Notify(method string, params interface{}) error {
+	return rc.Batch(context.Background(), []*RPCCall{{Method: method, Params: params, Notify: true}})
+}
+
+// RPCCall 批量调用里的一个调用，调用的错误保存在 Error 里
+type RPCCall struct {
+	Method string
+	Params interface{}
+	Result interface{}
+	//通知不等待响应
+	Notify bool
+	Error  error
+}
+
+// Batch 以一个JSON数组批量发送多个调用，等待所有非通知调用的响应。
+// 只有一个调用时按单个请求发送。返回的错误为发送或等待的错误，各个调用自己的错误保存在 RPCCall.Error 里
+func (rc *RPCConn) Batch(ctx context.Context, calls []*RPCCall) error {
+	if len(calls) == 0 {
+		return errRPCBatch
+	}
+	if _, ok := ctx.Deadline(); !ok && rc.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rc.CallTimeout)
+		defer cancel()
+	}
+
+	msgs := make([]*rpcMessage, len(calls))
+	ids := make([]uint64, len(calls))
+	chs := make([]chan *rpcMessage, len(calls))
+	for i, call := range calls {
+		msg := &rpcMessage{JSONRPC: rpcVersion, Method: call.Method}
+		if call.Params != nil {
+			params, err := json.Marshal(call.Params)
+			if err != nil {
+				return err
+			}
+			msg.Params = params
+		}
+		if !call.Notify {
+			ids[i] = atomic.AddUint64(&rc.nextID, 1)
+			chs[i] = make(chan *rpcMessage, 1)
+			msg.ID = json.RawMessage(strconv.FormatUint(ids[i], 10))
+		}
+		msgs[i] = msg
+	}
+
+	rc.mu.Lock()
+	if rc.err != nil {
+		rc.mu.Unlock()
+		return fmt.Errorf("%w: %v", ErrRPCStopped, rc.err)
+	}
+	for i, ch := range chs {
+		if ch != nil {
+			rc.pending[ids[i]] = ch
+		}
+	}
+	rc.mu.Unlock()
+	defer rc.forget(ids)
+
+	var err error
+	if len(msgs) == 1 {
+		err = rc.wc.WriteJSON(msgs[0])
+	} else {
+		err = rc.wc.WriteJSON(msgs)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, ch := range chs {
+		if ch == nil {
+			continue
+		}
+		select {
+		case resp := <-ch:
+			calls[i].Error = rpcResult(resp, calls[i].Result)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-rc.ctx.Done():
+			rc.mu.Lock()
+			err = rc.err
+			rc.mu.Unlock()
+			return fmt.Errorf("%w: %v", ErrRPCStopped, err)
+		}
+	}
+	return nil
+}
+
+// forget 移除没有等到响应的调用
+func (rc *RPCConn) forget(ids []uint64) {
+	rc.mu.Lock()
+	for _, id := range ids {
+		delete(rc.pending, id)
+	}
+	rc.mu.Unlock()
+}
+
+func rpcResult(resp *rpcMessage, result interface{}) error {
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result == nil || len(resp.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
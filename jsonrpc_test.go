@@ -0,0 +1,220 @@
+package mini_websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type addParams struct {
+	A, B int
+}
+
+// newRPCServer 测试用的方法
+func newRPCServer(t *testing.T) *RPCServer {
+	t.Helper()
+	s := NewRPCServer()
+	handlers := map[string]interface{}{
+		"add": func(ctx context.Context, p addParams) (int, error) { return p.A + p.B, nil },
+		"addPtr": func(ctx context.Context, p *addParams) (int, error) {
+			return p.A + p.B, nil
+		},
+		"void": func(ctx context.Context, p string) error { return nil },
+		"fail": func(ctx context.Context, p string) error {
+			return &RPCError{Code: 42, Message: "fail", Data: p}
+		},
+		"boom":  func(ctx context.Context, p string) error { return errors.New("boom") },
+		"panic": func(ctx context.Context, p string) error { panic("oops") },
+		"slow": func(ctx context.Context, p string) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		//回调调用方的方法
+		"greet": func(ctx context.Context, p string) (string, error) {
+			var name string
+			if err := RPCConnFromContext(ctx).Call(ctx, "name", nil, &name); err != nil {
+				return "", err
+			}
+			return p + ", " + name, nil
+		},
+	}
+	for name, h := range handlers {
+		if err := s.Register(name, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+// newRPCPair 服务端以 newRPCServer 提供方法，客户端提供client的方法
+func newRPCPair(t *testing.T, client *RPCServer) *RPCConn {
+	t.Helper()
+	server := newRPCServer(t)
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		_ = NewRPCConn(c, server).Serve()
+	})
+	rc := NewRPCConn(dialTest(t, s, nil), client)
+	go func() { _ = rc.Serve() }()
+	return rc
+}
+
+func TestRPCCall(t *testing.T) {
+	rc := newRPCPair(t, nil)
+	tests := []struct {
+		name   string
+		method string
+		params interface{}
+		want   interface{}
+		code   int
+	}{
+		{"result", "add", addParams{1, 2}, float64(3), 0},
+		{"pointer params", "addPtr", addParams{3, 4}, float64(7), 0},
+		{"no result", "void", "x", nil, 0},
+		{"rpc error", "fail", "why", nil, 42},
+		{"plain error", "boom", "x", nil, RPCInternalError},
+		{"panic", "panic", "x", nil, RPCInternalError},
+		{"unknown method", "missing", nil, nil, RPCMethodNotFound},
+		{"bad params", "add", "not an object", nil, RPCInvalidParams},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got interface{}
+			err := rc.Call(context.Background(), tt.method, tt.params, &got)
+			if tt.code != 0 {
+				var re *RPCError
+				if !errors.As(err, &re) || re.Code != tt.code {
+					t.Fatalf("err = %v, want code %d", err, tt.code)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("got %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRPCBatch(t *testing.T) {
+	rc := newRPCPair(t, nil)
+	var sum, sum2 int
+	calls := []*RPCCall{
+		{Method: "add", Params: addParams{1, 1}, Result: &sum},
+		{Method: "void", Params: "n", Notify: true},
+		{Method: "fail", Params: "x"},
+		{Method: "addPtr", Params: addParams{2, 2}, Result: &sum2},
+	}
+	if err := rc.Batch(context.Background(), calls); err != nil {
+		t.Fatal(err)
+	}
+	if sum != 2 || sum2 != 4 || calls[0].Error != nil || calls[3].Error != nil {
+		t.Fatalf("results %d %d, errors %v %v", sum, sum2, calls[0].Error, calls[3].Error)
+	}
+	var re *RPCError
+	if !errors.As(calls[2].Error, &re) || re.Code != 42 {
+		t.Fatalf("calls[2].Error = %v", calls[2].Error)
+	}
+	if err := rc.Batch(context.Background(), nil); err != errRPCBatch {
+		t.Fatalf("empty batch err = %v", err)
+	}
+	if err := rc.Notify("void", "n"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRPCServerCallsClient 服务端的方法可以调用客户端注册的方法
+func TestRPCServerCallsClient(t *testing.T) {
+	client := NewRPCServer()
+	if err := client.Register("name", func(ctx context.Context, p interface{}) (string, error) { return "client", nil }); err != nil {
+		t.Fatal(err)
+	}
+	rc := newRPCPair(t, client)
+
+	var got string
+	if err := rc.Call(context.Background(), "greet", "hello", &got); err != nil || got != "hello, client" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestRPCCallTimeout(t *testing.T) {
+	rc := newRPCPair(t, nil)
+	rc.CallTimeout = 50 * time.Millisecond
+	if err := rc.Call(context.Background(), "slow", "x", nil); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := rc.Call(ctx, "slow", "x", nil); err != context.Canceled {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+}
+
+// TestRPCStopped 连接断开后，进行中和之后的调用都返回 ErrRPCStopped
+func TestRPCStopped(t *testing.T) {
+	rc := newRPCPair(t, nil)
+	errc := make(chan error, 1)
+	go func() { errc <- rc.Call(context.Background(), "slow", "x", nil) }()
+	time.Sleep(20 * time.Millisecond)
+
+	_ = closeTcp(rc.Conn())
+	if err := <-errc; !errors.Is(err, ErrRPCStopped) {
+		t.Fatalf("pending call err = %v, want ErrRPCStopped", err)
+	}
+	if err := rc.Call(context.Background(), "add", addParams{}, nil); !errors.Is(err, ErrRPCStopped) {
+		t.Fatalf("later call err = %v, want ErrRPCStopped", err)
+	}
+}
+
+// TestRPCInvalidMessages 不合法的JSON和请求按规范以 id 为null 的错误响应
+func TestRPCInvalidMessages(t *testing.T) {
+	server := newRPCServer(t)
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		_ = NewRPCConn(c, server).Serve()
+	})
+	c := dialTest(t, s, nil)
+
+	tests := []struct {
+		name string
+		msg  string
+		id   string
+		code int
+	}{
+		{"parse error", `{"jsonrpc":`, "null", RPCParseError},
+		{"empty batch", `[]`, "null", RPCInvalidRequest},
+		{"wrong version", `{"jsonrpc":"1.0","id":7,"method":"add"}`, "7", RPCInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.SendMessage(tt.msg); err != nil {
+				t.Fatal(err)
+			}
+			var resp rpcMessage
+			if err := c.ReadJSON(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if string(resp.ID) != tt.id || resp.Error == nil || resp.Error.Code != tt.code {
+				data, _ := json.Marshal(resp)
+				t.Fatalf("response %s, want id %s code %d", data, tt.id, tt.code)
+			}
+		})
+	}
+}
+
+func TestRPCRegisterInvalid(t *testing.T) {
+	handlers := []interface{}{
+		"not a func",
+		func(p string) error { return nil },
+		func(ctx context.Context) error { return nil },
+		func(ctx context.Context, p string) string { return "" },
+		func(ctx context.Context, p string) (string, string, error) { return "", "", nil },
+	}
+	s := NewRPCServer()
+	for i, h := range handlers {
+		if err := s.Register("m", h); err != errRPCHandler {
+			t.Fatalf("handler %d: err = %v, want errRPCHandler", i, err)
+		}
+	}
+}
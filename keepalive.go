@@ -0,0 +1,86 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// SetPingHandler 设置收到ping帧时的处理函数，appData为ping帧的负载，h为nil时使用默认处理：回复相同负载的pong帧。
+// 处理函数在读协程里调用，返回的错误会由读取方法返回，应在开始读取前设置
+func (wc *WsConn) SetPingHandler(h func(appData []byte) error) {
+	if h == nil {
+		h = wc.Pong
+	}
+	wc.pingHandler = h
+}
+
+// SetPongHandler 设置收到pong帧时的处理函数，appData为pong帧的负载，h为nil时使用默认处理：什么都不做。
+// 处理函数在读协程里调用，返回的错误会由读取方法返回，应在开始读取前设置
+func (wc *WsConn) SetPongHandler(h func(appData []byte) error) {
+	if h == nil {
+		h = func([]byte) error { return nil }
+	}
+	wc.pongHandler = h
+}
+
+// StartKeepalive 每隔pingInterval发送一次ping帧，超过pongWait没有收到pong帧时认为连接已断开，
+// 关闭底层tcp连接，之后的读取返回 CloseAbnormal 的 CloseError。pongWait为0时使用pingInterval的两倍。
+// pong帧由读协程处理，开启后需要有协程持续读取消息；连接关闭后自动停止
+func (wc *WsConn) StartKeepalive(pingInterval, pongWait time.Duration) {
+	if pingInterval <= 0 {
+		return
+	}
+	if pongWait <= 0 {
+		pongWait = 2 * pingInterval
+	}
+
+	atomic.StoreInt64(&wc.lastPong, time.Now().UnixNano())
+	go wc.keepalive(pingInterval, pongWait)
+}
+
+func (wc *WsConn) keepalive(pingInterval, pongWait time.Duration) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		lastPong := time.Unix(0, atomic.LoadInt64(&wc.lastPong))
+		if time.Since(lastPong) > pongWait {
+			wc.logger.warn("c.keepalive pong timeout, closing dead connection", "lastPong", lastPong)
+			wc.keepaliveDead("超过" + pongWait.String() + "未收到pong帧")
+			return
+		}
+
+		//对端不再读取时ping会一直阻塞在写入上，超过pongWait仍未写出同样认为连接已断开
+		ctx, cancel := context.WithTimeout(context.Background(), pongWait)
+		err := wc.PingContext(ctx)
+		cancel()
+		if err == context.DeadlineExceeded {
+			wc.logger.warn("c.keepalive ping write timeout, closing dead connection", "pongWait", pongWait)
+			wc.keepaliveDead("超过" + pongWait.String() + "未能发出ping帧")
+			return
+		}
+		//已发送关闭帧或连接已断开时停止发送
+		if err != nil {
+			wc.logger.debug("c.keepalive stopped", "err", err)
+			return
+		}
+	}
+}
+
+// keepaliveDead 记录保活判定的断开原因并关闭底层tcp连接
+func (wc *WsConn) keepaliveDead(reason string) {
+	wc.deadErr.Store(&CloseError{Code: CloseAbnormal, Reason: reason})
+	_ = closeTcp(wc)
+}
+
+// readErr 保活判定连接断开后，读取到的网络错误都替换为保活的 CloseError
+func (wc *WsConn) readErr(err error) error {
+	if ce, ok := wc.deadErr.Load().(*CloseError); ok && err != nil {
+		return ce
+	}
+	return err
+}
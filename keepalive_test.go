@@ -0,0 +1,103 @@
+package mini_websocket
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestKeepalive 对端回复pong时连接保持，不回复时超过 PongWait 以 CloseAbnormal 断开
+func TestKeepalive(t *testing.T) {
+	tests := []struct {
+		name  string
+		pong  bool
+		alive bool
+	}{
+		{"pong replied", true, true},
+		{"pong missing", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ug := DefaultUpGrader
+			ug.PingInterval = 20 * time.Millisecond
+			ug.PongWait = 100 * time.Millisecond
+			errc := make(chan error, 1)
+			s := newTestServer(t, &ug, func(c *WsConn, r *http.Request) {
+				_, _, err := c.ReadMessage()
+				errc <- err
+			})
+
+			c := dialTest(t, s, nil)
+			var pings int64
+			c.SetPingHandler(func(appData []byte) error {
+				atomic.AddInt64(&pings, 1)
+				if tt.pong {
+					return c.Pong(appData)
+				}
+				return nil
+			})
+			go func() {
+				for {
+					if _, _, err := c.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}()
+
+			select {
+			case err := <-errc:
+				var ce *CloseError
+				if tt.alive || !errors.As(err, &ce) || ce.Code != CloseAbnormal {
+					t.Fatalf("server err = %v", err)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if !tt.alive {
+					t.Fatal("dead connection was not closed")
+				}
+			}
+			if n := atomic.LoadInt64(&pings); n < 3 {
+				t.Fatalf("got %d pings", n)
+			}
+		})
+	}
+}
+
+// TestKeepalivePeerNotReading 对端不再读取时ping阻塞在写入上，超过 PongWait 同样以 CloseAbnormal 断开
+func TestKeepalivePeerNotReading(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	c := NewWsConn(local, true, 0, 0, 0)
+	c.StartKeepalive(10*time.Millisecond, 50*time.Millisecond)
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadMessage()
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		var ce *CloseError
+		if !errors.As(err, &ce) || ce.Code != CloseAbnormal {
+			t.Fatalf("err = %v, want close code %d", err, CloseAbnormal)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("blocked ping kept the dead connection open")
+	}
+}
+
+// TestPingHandlerError 处理函数返回的错误由读取方法返回
+func TestPingHandlerError(t *testing.T) {
+	errPing := errors.New("ping rejected")
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		_ = c.Ping()
+	})
+	c := dialTest(t, s, nil)
+	c.SetPingHandler(func([]byte) error { return errPing })
+	if _, _, err := c.ReadMessage(); err != errPing {
+		t.Fatalf("err = %v, want %v", err, errPing)
+	}
+}
@@ -0,0 +1,187 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel 日志等级，取值与 log/slog 的等级一致
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = -4
+	LevelInfo  LogLevel = 0
+	LevelWarn  LogLevel = 4
+	LevelError LogLevel = 8
+)
+
+func (l LogLevel) String() string {
+	switch {
+	case l < LevelInfo:
+		return "DEBUG"
+	case l < LevelWarn:
+		return "INFO"
+	case l < LevelError:
+		return "WARN"
+	default:
+		return "ERROR"
+	}
+}
+
+// Logger 结构化日志，keysAndValues 为交替出现的键和值。
+// upGrader 和 Dialer 默认不输出任何日志
+type Logger interface {
+	// Enabled 是否输出该等级的日志，为false时不会构造日志的字段
+	Enabled(level LogLevel) bool
+	Log(level LogLevel, msg string, keysAndValues ...interface{})
+}
+
+// NewStdLogger 把不低于level的日志以 "LEVEL msg k=v ..." 的格式写入标准库的 *log.Logger，
+// l为nil时使用标准库默认的logger
+func NewStdLogger(l *log.Logger, level LogLevel) Logger {
+	return &stdLogger{l: l, level: level}
+}
+
+type stdLogger struct {
+	l     *log.Logger
+	level LogLevel
+}
+
+func (sl *stdLogger) Enabled(level LogLevel) bool {
+	return level >= sl.level
+}
+
+func (sl *stdLogger) Log(level LogLevel, msg string, keysAndValues ...interface{}) {
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 < len(keysAndValues) {
+			_, _ = fmt.Fprintf(&b, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+		} else {
+			_, _ = fmt.Fprintf(&b, " !BADKEY=%v", keysAndValues[i])
+		}
+	}
+
+	if sl.l == nil {
+		_ = log.Output(2, b.String())
+		return
+	}
+	_ = sl.l.Output(2, b.String())
+}
+
+// SlogLogger 标准库 log/slog 风格的日志，*slog.Logger 满足该接口
+type SlogLogger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// NewSlogLogger 把不低于level的日志转交给 log/slog 风格的logger，如 NewSlogLogger(slog.Default(), LevelInfo)
+func NewSlogLogger(l SlogLogger, level LogLevel) Logger {
+	return &slogLogger{l: l, level: level}
+}
+
+type slogLogger struct {
+	l     SlogLogger
+	level LogLevel
+}
+
+func (sl *slogLogger) Enabled(level LogLevel) bool {
+	return level >= sl.level
+}
+
+func (sl *slogLogger) Log(level LogLevel, msg string, keysAndValues ...interface{}) {
+	switch {
+	case level < LevelInfo:
+		sl.l.Debug(msg, keysAndValues...)
+	case level < LevelWarn:
+		sl.l.Info(msg, keysAndValues...)
+	case level < LevelError:
+		sl.l.Warn(msg, keysAndValues...)
+	default:
+		sl.l.Error(msg, keysAndValues...)
+	}
+}
+
+// logTo l为nil时什么都不输出
+func logTo(l Logger, level LogLevel, msg string, keysAndValues ...interface{}) {
+	if l != nil && l.Enabled(level) {
+		l.Log(level, msg, keysAndValues...)
+	}
+}
+
+// lastConnID 最近分配的连接ID
+var lastConnID uint64
+
+// connLogger 绑定在连接上的日志，每条日志都带上连接ID
+type connLogger struct {
+	l      Logger
+	id     uint64
+	redact bool //debug日志里是否隐藏消息负载
+}
+
+func (cl *connLogger) enabled(level LogLevel) bool {
+	return cl.l != nil && cl.l.Enabled(level)
+}
+
+func (cl *connLogger) log(level LogLevel, msg string, keysAndValues ...interface{}) {
+	if !cl.enabled(level) {
+		return
+	}
+	cl.l.Log(level, msg, append([]interface{}{"conn", cl.id}, keysAndValues...)...)
+}
+
+func (cl *connLogger) debug(msg string, keysAndValues ...interface{}) {
+	cl.log(LevelDebug, msg, keysAndValues...)
+}
+
+func (cl *connLogger) warn(msg string, keysAndValues ...interface{}) {
+	cl.log(LevelWarn, msg, keysAndValues...)
+}
+
+func (cl *connLogger) error(msg string, keysAndValues ...interface{}) {
+	cl.log(LevelError, msg, keysAndValues...)
+}
+
+// payload debug日志里输出的消息负载，输出时才转换成字符串，redact 为true时只输出长度。
+// 不输出debug日志时返回nil，避免每条消息都分配内存
+func (cl *connLogger) payload(p []byte) interface{} {
+	if !cl.enabled(LevelDebug) {
+		return nil
+	}
+	return logPayload{p: p, redact: cl.redact}
+}
+
+type logPayload struct {
+	p      []byte
+	redact bool
+}
+
+func (lp logPayload) String() string {
+	if lp.redact {
+		return fmt.Sprintf("[redacted %d bytes]", len(lp.p))
+	}
+	return string(lp.p)
+}
+
+// ID 连接ID，进程内唯一，日志里以 conn 字段输出
+func (wc *WsConn) ID() uint64 {
+	return wc.logger.id
+}
+
+// SetLogger 设置连接的日志，l为nil时不输出日志；redactPayload 为true时debug日志里不输出消息负载
+func (wc *WsConn) SetLogger(l Logger, redactPayload bool) {
+	wc.logger.l, wc.logger.redact = l, redactPayload
+}
+
+func newConnLogger() connLogger {
+	return connLogger{id: atomic.AddUint64(&lastConnID, 1)}
+}
@@ -0,0 +1,108 @@
+package mini_websocket
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordLogger 记录所有日志的 Logger
+type recordLogger struct {
+	mu      sync.Mutex
+	level   LogLevel
+	entries []string
+}
+
+func (rl *recordLogger) Enabled(level LogLevel) bool {
+	return level >= rl.level
+}
+
+func (rl *recordLogger) Log(level LogLevel, msg string, keysAndValues ...interface{}) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.entries = append(rl.entries, fmt.Sprint(level, " ", msg, keysAndValues))
+}
+
+func (rl *recordLogger) find(substr string) string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, e := range rl.entries {
+		if strings.Contains(e, substr) {
+			return e
+		}
+	}
+	return ""
+}
+
+func TestStdLogger(t *testing.T) {
+	tests := []struct {
+		name  string
+		level LogLevel
+		msg   string
+		kvs   []interface{}
+		want  string
+	}{
+		{"below level", LevelDebug, "dropped", nil, ""},
+		{"fields", LevelWarn, "slow peer", []interface{}{"conn", 1, "err", "timeout"}, "WARN slow peer conn=1 err=timeout\n"},
+		{"odd fields", LevelError, "bad", []interface{}{"conn", 1, "dangling"}, "ERROR bad conn=1 !BADKEY=dangling\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			l := NewStdLogger(log.New(&buf, "", 0), LevelInfo)
+			logTo(l, tt.level, tt.msg, tt.kvs...)
+			if buf.String() != tt.want {
+				t.Fatalf("got %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+// TestConnLogger 连接的日志都带上连接ID，redact 时debug日志只输出负载长度，没有设置日志时不输出
+func TestConnLogger(t *testing.T) {
+	tests := []struct {
+		name   string
+		logger *recordLogger
+		redact bool
+		want   string
+	}{
+		{"payload", &recordLogger{level: LevelDebug}, false, "secret"},
+		{"redacted", &recordLogger{level: LevelDebug}, true, "[redacted 6 bytes]"},
+		{"warn only", &recordLogger{level: LevelWarn}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewWsConn(&writeConn{}, true, 0, 0, 0)
+			c.SetLogger(tt.logger, tt.redact)
+			if err := c.SendMessage("secret"); err != nil {
+				t.Fatal(err)
+			}
+
+			e := tt.logger.find("send data frame")
+			if tt.want == "" {
+				if e != "" {
+					t.Fatalf("unexpected entry %q", e)
+				}
+				return
+			}
+			if !strings.Contains(e, fmt.Sprint("conn ", c.ID())) || !strings.Contains(e, tt.want) {
+				t.Fatalf("entry %q, want conn %d and %q", e, c.ID(), tt.want)
+			}
+			if tt.redact && strings.Contains(e, "secret") {
+				t.Fatalf("payload leaked: %q", e)
+			}
+		})
+	}
+
+	//没有设置日志时不构造负载字段
+	c := NewWsConn(&writeConn{}, true, 0, 0, 0)
+	if p := c.logger.payload([]byte("x")); p != nil {
+		t.Fatalf("payload = %v, want nil", p)
+	}
+	if other := NewWsConn(&writeConn{}, true, 0, 0, 0); other.ID() == c.ID() {
+		t.Fatal("conn ids are not unique")
+	}
+}
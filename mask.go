@@ -0,0 +1,65 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// maskKeySource 从 crypto/rand 批量读取随机数，按4个字节一个掩码取出，减少系统调用
+var maskKeySource struct {
+	mu  sync.Mutex
+	buf [512]byte
+	pos int
+}
+
+func init() {
+	maskKeySource.pos = len(maskKeySource.buf)
+}
+
+// newMaskingKey 取出一个不可预测的掩码
+func newMaskingKey() uint32 {
+	s := &maskKeySource
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pos == len(s.buf) {
+		if _, err := io.ReadFull(rand.Reader, s.buf[:]); err != nil {
+			panic(err)
+		}
+		s.pos = 0
+	}
+	key := binary.BigEndian.Uint32(s.buf[s.pos:])
+	s.pos += 4
+	return key
+}
+
+// maskBytes 把b当作负载里从第pos个字节开始的一段做掩码处理，返回下一段的pos，
+// 用于分段处理同一个帧的负载。每次处理8个字节，剩余不足8个字节的部分逐字节处理
+func maskBytes(maskingKey uint32, pos int, b []byte) int {
+	var key [4]byte
+	binary.BigEndian.PutUint32(key[:], maskingKey)
+
+	i := 0
+	if len(b) >= 8 {
+		//负载第n个字节使用 key[n%4]，从pos开始的8个字节对应的掩码
+		var kb [8]byte
+		for j := range kb {
+			kb[j] = key[(pos+j)&3]
+		}
+		kw := binary.LittleEndian.Uint64(kb[:])
+
+		for ; i+8 <= len(b); i += 8 {
+			binary.LittleEndian.PutUint64(b[i:], binary.LittleEndian.Uint64(b[i:])^kw)
+		}
+	}
+
+	for ; i < len(b); i++ {
+		b[i] ^= key[(pos+i)&3]
+	}
+	return pos + len(b)
+}
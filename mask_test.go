@@ -0,0 +1,134 @@
+package mini_websocket
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// maskBytesRef 逐字节的参考实现
+func maskBytesRef(maskingKey uint32, pos int, b []byte) int {
+	key := [4]byte{byte(maskingKey >> 24), byte(maskingKey >> 16), byte(maskingKey >> 8), byte(maskingKey)}
+	for i := range b {
+		b[i] ^= key[(pos+i)%4]
+	}
+	return pos + len(b)
+}
+
+// maskTestPayload 长度为n的确定性负载
+func maskTestPayload(n int) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(i*31 + 7)
+	}
+	return p
+}
+
+func TestMaskBytesRFCExample(t *testing.T) {
+	//RFC 6455 5.7：掩码 37 fa 21 3d 的 "Hello"
+	p := []byte("Hello")
+	if pos := maskBytes(0x37fa213d, 0, p); pos != 5 {
+		t.Fatalf("pos = %d", pos)
+	}
+	if want := []byte{0x7f, 0x9f, 0x4d, 0x51, 0x58}; !bytes.Equal(p, want) {
+		t.Fatalf("got %x, want %x", p, want)
+	}
+}
+
+func TestMaskBytesVectors(t *testing.T) {
+	keys := []uint32{0x00000000, 0xffffffff, 0x37fa213d, 0x01020304, 0xdeadbeef}
+	positions := []int{0, 1, 2, 3, 4, 5, 7, 1021}
+
+	for _, key := range keys {
+		for _, pos := range positions {
+			for n := 0; n <= 17; n++ {
+				t.Run(fmt.Sprintf("key=%08x/pos=%d/len=%d", key, pos, n), func(t *testing.T) {
+					got, want := maskTestPayload(n), maskTestPayload(n)
+					gotPos := maskBytes(key, pos, got)
+					wantPos := maskBytesRef(key, pos, want)
+					if gotPos != wantPos {
+						t.Fatalf("pos = %d, want %d", gotPos, wantPos)
+					}
+					if !bytes.Equal(got, want) {
+						t.Fatalf("got %x, want %x", got, want)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestMaskBytesChunked(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []int
+	}{
+		{"ones", []int{1, 1, 1, 1, 1, 1, 1, 1, 1}},
+		{"uneven", []int{3, 9, 1, 17, 0, 5, 8, 13, 2}},
+		{"word-aligned", []int{8, 16, 8, 24}},
+		{"large-tail", []int{7, 1000, 3, 333}},
+	}
+	const key = 0x37fa213d
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total := 0
+			for _, n := range tt.chunks {
+				total += n
+			}
+			got, want := maskTestPayload(total), maskTestPayload(total)
+			maskBytesRef(key, 0, want)
+
+			//分段处理时把返回的pos传给下一段
+			pos, off := 0, 0
+			for _, n := range tt.chunks {
+				pos = maskBytes(key, pos, got[off:off+n])
+				off += n
+			}
+			if pos != total {
+				t.Fatalf("pos = %d, want %d", pos, total)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("chunked masking differs from reference")
+			}
+
+			//再次掩码还原负载
+			maskBytes(key, 0, got)
+			if !bytes.Equal(got, maskTestPayload(total)) {
+				t.Fatalf("masking twice did not restore payload")
+			}
+		})
+	}
+}
+
+func TestNewMaskingKeyUnique(t *testing.T) {
+	//跨越多次批量读取，掩码不应重复出现
+	const n = 1000
+	seen := make(map[uint32]bool, n)
+	for i := 0; i < n; i++ {
+		seen[newMaskingKey()] = true
+	}
+	if len(seen) < n-2 {
+		t.Fatalf("only %d distinct keys out of %d", len(seen), n)
+	}
+}
+
+func BenchmarkMaskBytes(b *testing.B) {
+	for _, n := range []int{7, 16, 125, 1024, 64 << 10} {
+		p := maskTestPayload(n)
+		b.Run(fmt.Sprintf("len=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(n))
+			for i := 0; i < b.N; i++ {
+				maskBytes(0x37fa213d, 1, p)
+			}
+		})
+	}
+}
+
+func BenchmarkNewMaskingKey(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		newMaskingKey()
+	}
+}
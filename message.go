@@ -0,0 +1,344 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var (
+	errWriterClosed   = errors.New("消息写入流已关闭")
+	errNotDataMessage = errors.New("只能以流的方式发送text、binary和扩展占用的非控制帧opcode的消息")
+
+	ErrReadLimit = errors.New("消息超过了读取限制")
+)
+
+// NextReader 返回下一条数据消息的类型和负载读取流，负载随着分片的到达逐步读出，
+// 分片之间的ping、pong会被自动处理；扩展占用的控制帧opcode也作为单独的消息返回。
+// 调用 NextReader 会丢弃上一条消息未读完的部分
+func (wc *WsConn) NextReader() (MessageType, io.Reader, error) {
+	//已经收到对端的关闭帧
+	if wc.closeErr != nil {
+		return NoFrame, nil, wc.closeErr
+	}
+	//第一次读取时才分配读缓冲区
+	if wc.BufRD == nil {
+		wc.BufRD = bufio.NewReaderSize(wc.Conn, wc.readBufferSize)
+	}
+
+	//读完上一条消息，保证字节流停在下一个帧的开头
+	if wc.reader != nil {
+		if _, err := io.Copy(ioutil.Discard, wc.reader); err != nil {
+			return NoFrame, nil, err
+		}
+		wc.reader = nil
+	}
+
+	for {
+		frame, remain, err := readFrameHeader(wc)
+		if err != nil {
+			return NoFrame, nil, err
+		}
+
+		if err = checkReadLimit(wc, 0, remain); err != nil {
+			return NoFrame, nil, err
+		}
+
+		mt := MessageType(frame.OpCode)
+		if isControlOpCode(mt) {
+			if frame.Payload, err = readPayload(wc, remain); err != nil {
+				return NoFrame, nil, err
+			}
+			//关闭帧会以 CloseError 的形式返回
+			if err = handleFrame(wc, frame); err != nil {
+				return NoFrame, nil, err
+			}
+			if mt == PingFrame || mt == PongFrame {
+				//事件循环模式下没有更多数据时不阻塞，等待下一次可读事件
+				if wc.poll != nil && !wc.poll.ready() {
+					return NoFrame, nil, errPollIdle
+				}
+				continue
+			}
+
+			//扩展占用的控制帧
+			mr := &messageReader{wc: wc, final: true, buf: frame.Payload}
+			wc.reader = mr
+			return mt, mr, nil
+		}
+
+		if mt == ContinuationFrame {
+			wc.logger.warn("Conn.NextReader got continuation frame without start frame")
+			_ = wc.CloseWrongProtocol()
+			return NoFrame, nil, ErrContinuationNoStart
+		}
+
+		mr := &messageReader{wc: wc}
+		if err = mr.setFrame(frame, remain); err != nil {
+			return NoFrame, nil, err
+		}
+
+		//交给扩展还原消息负载，扩展在消息第一个帧上设置的rsv位，作用于整条消息
+		r, err := wc.wrapMessageReader(mt, frame.RSV(), mr)
+		if err != nil {
+			wc.logger.error("Conn.NextReader failed to wrap reader", "err", err)
+			_ = wc.CloseInternalError()
+			return NoFrame, nil, err
+		}
+		if r != io.Reader(mr) {
+			//扩展还原后的消息同样受读取限制，避免压缩炸弹
+			r = &decodeReader{wc: wc, mr: mr, r: r}
+		}
+		if mt == TextFrame {
+			r = &textReader{wc: wc, r: r}
+		}
+
+		wc.reader = r
+		return mt, r, nil
+	}
+}
+
+// messageReader 按帧读取一条消息的负载
+type messageReader struct {
+	wc *WsConn
+
+	frame  *Frame //当前帧，负载未读完的部分还在 WsConn.BufRD 里
+	remain uint64 //当前帧未读的负载字节数
+	total  uint64 //已经收到的所有分片的负载字节数
+	pos    int    //当前帧已读的负载字节数，用于分段去掉掩码
+	final  bool   //当前帧是否为消息的最后一个帧
+
+	buf []byte //需要逐帧变换时，当前帧的负载会被整个读出
+	err error
+}
+
+// setFrame 切换到消息的下一个数据帧
+func (mr *messageReader) setFrame(frame *Frame, remain uint64) error {
+	mr.frame, mr.remain, mr.pos, mr.final = frame, remain, 0, frame.IsFinal()
+	mr.total += remain
+
+	//扩展需要逐帧变换时，只能读出整个帧再交给扩展
+	if mr.wc.hasFrameTransformer() {
+		payload, err := readPayload(mr.wc, remain)
+		if err != nil {
+			return err
+		}
+		frame.Payload = payload
+		if err = handleFrame(mr.wc, frame); err != nil {
+			return err
+		}
+		mr.buf, mr.remain = frame.Payload, 0
+	}
+	return nil
+}
+
+func (mr *messageReader) Read(p []byte) (int, error) {
+	for mr.err == nil {
+		if len(mr.buf) > 0 {
+			n := copy(p, mr.buf)
+			mr.buf = mr.buf[n:]
+			return n, nil
+		}
+
+		if mr.remain > 0 {
+			if uint64(len(p)) > mr.remain {
+				p = p[:mr.remain]
+			}
+			n, err := mr.wc.BufRD.Read(p)
+			err = mr.wc.readErr(err)
+			if mr.frame.Mask == 1 {
+				mr.pos = maskBytes(mr.frame.MaskingKey, mr.pos, p[:n])
+			}
+			mr.remain -= uint64(n)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			mr.err = err
+			return n, err
+		}
+
+		if mr.final {
+			mr.err = io.EOF
+			break
+		}
+
+		mr.err = mr.nextFrame()
+	}
+
+	return 0, mr.err
+}
+
+// nextFrame 读取消息的下一个分片，分片之间的控制帧读完后直接处理
+func (mr *messageReader) nextFrame() error {
+	for {
+		frame, remain, err := readFrameHeader(mr.wc)
+		if err != nil {
+			return err
+		}
+
+		switch mt := MessageType(frame.OpCode); {
+		case mt == ContinuationFrame:
+			if err = checkReadLimit(mr.wc, mr.total, remain); err != nil {
+				return err
+			}
+			return mr.setFrame(frame, remain)
+		case isControlOpCode(mt):
+			if err = checkReadLimit(mr.wc, 0, remain); err != nil {
+				return err
+			}
+			if frame.Payload, err = readPayload(mr.wc, remain); err != nil {
+				return err
+			}
+			if err = handleFrame(mr.wc, frame); err != nil {
+				return err
+			}
+		default:
+			mr.wc.logger.warn("Conn.NextReader got new data frame in the middle of a fragmented message")
+			_ = mr.wc.CloseWrongProtocol()
+			return ErrDataFrameInterleaved
+		}
+	}
+}
+
+// decodeReader 扩展还原负载出错时，以 CloseDifferentMsgType 关闭连接；
+// 还原后的消息超过读取限制时，以 CloseTooBigData 关闭连接
+type decodeReader struct {
+	wc *WsConn
+	mr *messageReader
+	r  io.Reader
+	n  int64 //已经还原出的字节数
+}
+
+func (dr *decodeReader) Read(p []byte) (int, error) {
+	n, err := dr.r.Read(p)
+	dr.n += int64(n)
+	if limit := dr.wc.readLimit; limit > 0 && dr.n > limit {
+		dr.wc.logger.warn("Conn.NextReader decoded message exceeds read limit", "limit", limit)
+		_ = dr.wc.CloseTooBigData()
+		return 0, ErrReadLimit
+	}
+	if err != nil && err != io.EOF && err != dr.mr.err {
+		dr.wc.logger.warn("Conn.NextReader failed to decode message", "err", err)
+		_ = dr.wc.CloseDifferentMsgType()
+	}
+	return n, err
+}
+
+// NextWriter 返回以流的方式发送一条消息的写入流，写入的数据每攒满 shardSize 字节就作为一个分片发送，
+// Close 时发送设置了FIN的最后一个分片。在 Close 之前，其他数据消息的发送都会被阻塞
+func (wc *WsConn) NextWriter(mt MessageType) (io.WriteCloser, error) {
+	switch {
+	case mt == TextFrame, mt == BinaryFrame:
+	case !isControlOpCode(mt) && wc.claimedOpCode(mt):
+	default:
+		return nil, errNotDataMessage
+	}
+
+	wc.msgMu.Lock()
+
+	//frameWriter 嵌在 messageWriter 里，一条消息只分配一次
+	mw := &messageWriter{wc: wc, fw: frameWriter{wc: wc, mt: mt, first: true}}
+	w, rsv, err := wc.wrapMessageWriter(mt, &mw.fw)
+	if err != nil {
+		wc.msgMu.Unlock()
+		return nil, err
+	}
+	mw.w, mw.fw.rsv = w, rsv
+
+	return mw, nil
+}
+
+// messageWriter NextWriter 返回的写入流，Close 后释放 WsConn.msgMu
+type messageWriter struct {
+	wc     *WsConn
+	w      io.WriteCloser
+	fw     frameWriter
+	closed bool
+}
+
+func (mw *messageWriter) Write(p []byte) (int, error) {
+	if mw.closed {
+		return 0, errWriterClosed
+	}
+	return mw.w.Write(p)
+}
+
+func (mw *messageWriter) Close() error {
+	if mw.closed {
+		return errWriterClosed
+	}
+	mw.closed = true
+	defer mw.wc.msgMu.Unlock()
+
+	return mw.w.Close()
+}
+
+// frameWriter 把编码后的负载切分成帧发送
+type frameWriter struct {
+	wc    *WsConn
+	mt    MessageType
+	rsv   uint16 //扩展要求在第一个帧上设置的rsv位
+	first bool
+	shard *[]byte //从 shardPool 取出的分片缓冲区，第一次写入时取出，Close 时放回
+	buf   []byte
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		//缓冲区满了并且还有数据时才发送，保证 Close 时至少还有最后一个帧
+		if len(fw.buf) == shardSize {
+			if err := fw.flushFrame(false); err != nil {
+				return 0, err
+			}
+		}
+		if fw.shard == nil {
+			fw.shard = getShard()
+			fw.buf = *fw.shard
+		}
+
+		m := copy(fw.buf[len(fw.buf):shardSize], p)
+		fw.buf = fw.buf[:len(fw.buf)+m]
+		p = p[m:]
+	}
+	return n, nil
+}
+
+func (fw *frameWriter) Close() error {
+	defer fw.release()
+	return fw.flushFrame(true)
+}
+
+// release 把分片缓冲区放回 shardPool
+func (fw *frameWriter) release() {
+	if fw.shard != nil {
+		putShard(fw.shard)
+		fw.shard, fw.buf = nil, nil
+	}
+}
+
+// flushFrame 把缓冲区的数据作为一个帧发送，第一个帧使用消息的opcode，其余为延续帧
+func (fw *frameWriter) flushFrame(final bool) error {
+	opcode := ContinuationFrame
+	var rsv uint16
+	if fw.first {
+		opcode, rsv = fw.mt, fw.rsv
+	}
+
+	frame := constructFrame(opcode, final, fw.wc.IsServer)
+	frame.SetRSV(rsv)
+	frame.SetPayload(fw.buf)
+
+	fw.first = false
+	fw.buf = fw.buf[:0]
+
+	if err := sendFrame(fw.wc, frame); err != nil {
+		fw.wc.logger.debug("c.send failed to c.sendFrame", "err", err)
+		return err
+	}
+	return nil
+}
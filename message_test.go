@@ -0,0 +1,177 @@
+package mini_websocket
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// loopConn 不断重复返回同一段字节流的连接，写入的数据直接丢弃
+type loopConn struct {
+	data []byte
+	pos  int
+}
+
+func (c *loopConn) Read(p []byte) (int, error) {
+	n := copy(p, c.data[c.pos:])
+	c.pos = (c.pos + n) % len(c.data)
+	return n, nil
+}
+
+func (c *loopConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c *loopConn) Close() error                       { return nil }
+func (c *loopConn) LocalAddr() net.Addr                { return nil }
+func (c *loopConn) RemoteAddr() net.Addr               { return nil }
+func (c *loopConn) SetDeadline(t time.Time) error      { return nil }
+func (c *loopConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *loopConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// writeConn 记录写入的字节，读取时返回 io.EOF
+type writeConn struct {
+	loopConn
+	buf bytes.Buffer
+}
+
+func (c *writeConn) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (c *writeConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
+
+// countFrames 按帧头部声明的长度遍历帧字节流
+func countFrames(t *testing.T, b []byte) int {
+	t.Helper()
+	n := 0
+	for len(b) > 0 {
+		f := ParseToFrameHeader(b)
+		hdr, length := 2, uint64(f.PayloadLen)
+		switch f.PayloadLen {
+		case 126:
+			length = uint64(b[2])<<8 | uint64(b[3])
+			hdr += 2
+		case 127:
+			length = 0
+			for _, c := range b[2:10] {
+				length = length<<8 | uint64(c)
+			}
+			hdr += 8
+		}
+		if f.Mask == 1 {
+			hdr += 4
+		}
+		b = b[hdr+int(length):]
+		n++
+	}
+	return n
+}
+
+// TestNextReaderStreams 第一个分片到达后 NextReader 就能读出负载，不等待整条消息
+func TestNextReaderStreams(t *testing.T) {
+	sent := make(chan struct{}, 1)
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		writeRaw(t, c, rawFrame(TextFrame, false, 0, false, []byte("hel")))
+		<-sent
+		writeRaw(t, c, rawFrame(PingFrame, true, 0, false, []byte("p")))
+		writeRaw(t, c, rawFrame(ContinuationFrame, true, 0, false, []byte("lo")))
+	})
+	c := dialTest(t, s, nil)
+
+	mt, r, err := c.NextReader()
+	if err != nil || mt != TextFrame {
+		t.Fatalf("NextReader = %v, %v", mt, err)
+	}
+	p := make([]byte, 3)
+	if _, err = io.ReadFull(r, p); err != nil || string(p) != "hel" {
+		t.Fatalf("first fragment = %q, %v", p, err)
+	}
+	sent <- struct{}{}
+
+	//分片之间的ping被自动处理
+	rest, err := ioutil.ReadAll(r)
+	if err != nil || string(rest) != "lo" {
+		t.Fatalf("rest = %q, %v", rest, err)
+	}
+}
+
+// TestNextReaderDiscardsUnread 调用 NextReader 丢弃上一条消息未读完的部分
+func TestNextReaderDiscardsUnread(t *testing.T) {
+	var frames []byte
+	frames = append(frames, rawFrame(BinaryFrame, false, 0, true, bytes.Repeat([]byte("a"), shardSize))...)
+	frames = append(frames, rawFrame(ContinuationFrame, true, 0, true, bytes.Repeat([]byte("a"), shardSize))...)
+	frames = append(frames, rawFrame(TextFrame, true, 0, true, []byte("second"))...)
+	c := NewWsConn(&loopConn{data: frames}, true, 0, 0, 0)
+
+	_, r, err := c.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	mt, r, err := c.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ioutil.ReadAll(r)
+	if err != nil || mt != TextFrame || string(p) != "second" {
+		t.Fatalf("got %v %q, %v", mt, p, err)
+	}
+}
+
+// TestNextWriterFrames 写入的数据每满 shardSize 字节发送一个分片，Close 时发送最后一个分片
+func TestNextWriterFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		n      int
+		frames int
+	}{
+		{"empty", 0, 1},
+		{"small", 10, 1},
+		{"one shard", shardSize, 1},
+		{"fragmented", 2*shardSize + shardSize/2, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &writeConn{}
+			c := NewWsConn(conn, true, 0, 0, 0)
+			w, err := c.NextWriter(BinaryFrame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload := incompressible(tt.n)
+			for p := payload; len(p) > 0; {
+				n := minInt(len(p), 1000)
+				if _, err = w.Write(p[:n]); err != nil {
+					t.Fatal(err)
+				}
+				p = p[n:]
+			}
+			if err = w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = w.Write([]byte("x")); err != errWriterClosed {
+				t.Fatalf("Write after Close = %v", err)
+			}
+
+			b := conn.buf.Bytes()
+			if got := countFrames(t, b); got != tt.frames {
+				t.Fatalf("frames = %d, want %d", got, tt.frames)
+			}
+			peer := NewWsConn(&loopConn{data: b}, false, 0, 0, 0)
+			mt, p, err := peer.ReadMessage()
+			if err != nil || mt != BinaryFrame || !bytes.Equal(p, payload) {
+				t.Fatalf("read back mt=%v len=%d err=%v", mt, len(p), err)
+			}
+		})
+	}
+}
+
+func TestNextWriterRejectsControl(t *testing.T) {
+	c := NewWsConn(&writeConn{}, true, 0, 0, 0)
+	for _, mt := range []MessageType{PingFrame, PongFrame, ConnectionCloseFrame, ContinuationFrame, 0x3} {
+		if _, err := c.NextWriter(mt); err != errNotDataMessage {
+			t.Fatalf("NextWriter(%v) = %v, want errNotDataMessage", mt, err)
+		}
+	}
+}
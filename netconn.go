@@ -0,0 +1,177 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// NetConn 把websocket连接包装成 net.Conn，用于在只放行websocket的代理后面隧道传输基于tcp的协议（如ssh、数据库协议、grpc）。
+// Read 跨越消息边界连续读取收到的text和binary消息，对端正常关闭时返回 io.EOF；
+// Write 每次最多把 shardSize 个字节作为一条msgType类型的消息发送，隧道传输任意字节时应使用 BinaryFrame，
+// text消息要求每条消息都是合法的UTF-8：超过 shardSize 的写入在rune边界处切分，写入末尾不完整的字符留到下一次写入一起发送，
+// Close 时仍不完整的字符被丢弃并返回 ErrInvalidUTF8；超时和关闭对应websocket连接的超时和关闭握手。
+// 包装后不应再直接读取ws
+func NetConn(ws *WsConn, msgType MessageType) net.Conn {
+	return &netConn{ws: ws, mt: msgType}
+}
+
+type netConn struct {
+	ws *WsConn
+	mt MessageType
+
+	readMu sync.Mutex
+	reader io.Reader //当前正在读取的消息，读完后为nil
+
+	writeMu sync.Mutex
+	tail    []byte //text消息上一次写入末尾不完整的字符，最多 utf8.UTFMax-1 个字节
+}
+
+func (c *netConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for {
+		if c.reader == nil {
+			mt, r, err := c.ws.NextReader()
+			if err != nil {
+				return 0, netConnReadErr(err)
+			}
+			//扩展占用的opcode不属于字节流
+			if mt != TextFrame && mt != BinaryFrame {
+				continue
+			}
+			c.reader = r
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			//当前消息读完了，没有读到数据时接着读下一条消息，不返回空读
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// netConnReadErr 对端正常关闭或离开时，字节流正常结束
+func netConnReadErr(err error) error {
+	var ce *CloseError
+	if errors.As(err, &ce) && (ce.Code == CloseRight || ce.Code == CloseAsideLeaving) {
+		return io.EOF
+	}
+	return err
+}
+
+func (c *netConn) Write(p []byte) (int, error) {
+	if c.mt != TextFrame {
+		return c.send(p)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	//一个字符可能被调用方拆到两次写入里，接上上一次留下的部分
+	b, held := p, len(c.tail)
+	if held > 0 {
+		b = make([]byte, 0, held+len(p))
+		b = append(append(b, c.tail...), p...)
+	}
+	end := incompleteRune(b)
+	n, err := c.send(b[:end])
+	if err != nil {
+		if n -= held; n < 0 {
+			n = 0
+		}
+		return n, err
+	}
+	c.tail = append(c.tail[:0], b[end:]...)
+	return len(p), nil
+}
+
+// send 每次最多把 shardSize 个字节作为一条消息发送
+func (c *netConn) send(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		end := n + shardSize
+		if end > len(p) {
+			end = len(p)
+		}
+		//text消息不能把一个rune切到两条消息里，往前退到rune的开头
+		if c.mt == TextFrame && end < len(p) {
+			for i := end; i > end-utf8.UTFMax && i > n; i-- {
+				if utf8.RuneStart(p[i]) {
+					end = i
+					break
+				}
+			}
+		}
+		if err := sendDataFrame(c.ws, p[n:end], c.mt); err != nil {
+			return n, err
+		}
+		n = end
+	}
+	return n, nil
+}
+
+// incompleteRune 返回b末尾不完整的字符的开头，没有时返回len(b)；不合法的编码原样发送，由对端拒绝
+func incompleteRune(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i > len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
+
+// Close 发起关闭握手，等待对端的关闭帧后关闭底层连接，不会阻塞。
+// text消息还留有不完整的字符时，这部分无法发送，丢弃后返回 ErrInvalidUTF8
+func (c *netConn) Close() error {
+	c.writeMu.Lock()
+	held := len(c.tail)
+	c.tail = nil
+	c.writeMu.Unlock()
+
+	if err := c.ws.CloseRight(); err != nil {
+		return err
+	}
+	if held > 0 {
+		return ErrInvalidUTF8
+	}
+	return nil
+}
+
+func (c *netConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *netConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *netConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *netConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *netConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
@@ -0,0 +1,196 @@
+package mini_websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestNetConn 字节流跨越消息边界读写，对端正常关闭时读到 io.EOF
+func TestNetConn(t *testing.T) {
+	serverErr := make(chan error, 1)
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		nc := NetConn(c, BinaryFrame)
+		_, err := io.Copy(nc, nc)
+		serverErr <- err
+	})
+	ws := dialTest(t, s, nil)
+	nc := NetConn(ws, BinaryFrame)
+	if nc.LocalAddr() == nil || nc.RemoteAddr() == nil {
+		t.Fatal("missing addresses")
+	}
+
+	tests := []struct {
+		name   string
+		writes []int
+	}{
+		{"small", []int{5}},
+		{"several writes", []int{1, 2, 3, 1000}},
+		{"larger than a shard", []int{2*shardSize + 17}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want []byte
+			for _, n := range tt.writes {
+				p := maskTestPayload(n)
+				want = append(want, p...)
+				if m, err := nc.Write(p); err != nil || m != n {
+					t.Fatalf("Write = %d, %v", m, err)
+				}
+			}
+			_ = nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(nc, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatal("echoed bytes differ")
+			}
+		})
+	}
+
+	//空消息不会产生空读
+	if err := ws.SendMessage(""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nc.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 8)
+	if n, err := nc.Read(b); err != nil || string(b[:n]) != "x" {
+		t.Fatalf("Read = %q, %v", b[:n], err)
+	}
+
+	if err := nc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatalf("server copy err = %v, want nil after io.EOF", err)
+	}
+}
+
+// TestNetConnTextRuneBoundary text消息按rune边界切分，跨越 shardSize 的多字节字符不会被拆开
+func TestNetConnTextRuneBoundary(t *testing.T) {
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		nc := NetConn(c, TextFrame)
+		_, _ = io.Copy(nc, nc)
+	})
+	nc := NetConn(dialTest(t, s, nil), TextFrame)
+
+	tests := []struct {
+		name string
+		p    string
+	}{
+		{"two bytes", strings.Repeat("a", shardSize-1) + "é"},
+		{"three bytes", strings.Repeat("a", shardSize-2) + "中文"},
+		{"four bytes", strings.Repeat("a", shardSize-3) + "😀"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if n, err := nc.Write([]byte(tt.p)); err != nil || n != len(tt.p) {
+				t.Fatalf("Write = %d, %v", n, err)
+			}
+			_ = nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got := make([]byte, len(tt.p))
+			if _, err := io.ReadFull(nc, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.p {
+				t.Fatal("echoed text differs")
+			}
+		})
+	}
+}
+
+// TestNetConnTextSplitRune 一个字符被拆到两次写入里时，等字符完整后再发送
+func TestNetConnTextSplitRune(t *testing.T) {
+	got := make(chan string, 1)
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		var sb strings.Builder
+		for {
+			_, p, err := c.ReadMessage()
+			if errors.Is(err, ErrInvalidUTF8) {
+				got <- err.Error()
+				return
+			}
+			if err != nil {
+				got <- sb.String()
+				return
+			}
+			sb.Write(p)
+		}
+	})
+	nc := NetConn(dialTest(t, s, nil), TextFrame)
+
+	p := []byte("a中b😀")
+	for _, chunk := range [][]byte{p[:2], p[2:3], p[3:6], p[6:]} {
+		if n, err := nc.Write(chunk); err != nil || n != len(chunk) {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+	}
+	if err := nc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-got; s != string(p) {
+		t.Fatalf("server got %q, want %q", s, p)
+	}
+}
+
+// TestNetConnTextCloseIncomplete Close 时还有不完整的字符，丢弃并返回 ErrInvalidUTF8
+func TestNetConnTextCloseIncomplete(t *testing.T) {
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	nc := NetConn(dialTest(t, s, nil), TextFrame)
+	if _, err := nc.Write([]byte("中")[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Close(); !errors.Is(err, ErrInvalidUTF8) {
+		t.Fatalf("Close = %v, want %v", err, ErrInvalidUTF8)
+	}
+}
+
+func TestNetConnDeadline(t *testing.T) {
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {})
+	nc := NetConn(dialTest(t, s, nil), BinaryFrame)
+
+	if err := nc.SetDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := nc.Read(make([]byte, 1))
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+}
+
+// TestNetConnReadErr 正常关闭和离开时字节流结束，其他关闭原因原样返回
+func TestNetConnReadErr(t *testing.T) {
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{&CloseError{Code: CloseRight}, io.EOF},
+		{&CloseError{Code: CloseAsideLeaving}, io.EOF},
+		{&CloseError{Code: CloseWrongProtocol}, nil},
+		{ErrReadLimit, nil},
+	}
+	for _, tt := range tests {
+		want := tt.want
+		if want == nil {
+			want = tt.err
+		}
+		if got := netConnReadErr(tt.err); got != want {
+			t.Fatalf("netConnReadErr(%v) = %v, want %v", tt.err, got, want)
+		}
+	}
+}
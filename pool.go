@@ -0,0 +1,103 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+const maxPooledBufferSize = 1 << 20 //超过该容量的缓冲区用完后直接丢弃，避免池里长期占用大块内存
+
+// bufferPool 所有连接共用的消息缓冲区，用于组装读到的消息和扩展编码后的负载
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer 放回缓冲区，b为nil时什么都不做
+func putBuffer(b *bytes.Buffer) {
+	if b == nil || b.Cap() > maxPooledBufferSize {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
+
+// shardPool 所有连接共用的分片缓冲区，容量为 shardSize，用于 NextWriter 攒满一个分片再发送
+var shardPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, shardSize)
+		return &b
+	},
+}
+
+func getShard() *[]byte {
+	return shardPool.Get().(*[]byte)
+}
+
+func putShard(b *[]byte) {
+	*b = (*b)[:0]
+	shardPool.Put(b)
+}
+
+// readerPool 事件循环模式下连接可读时借用的读缓冲区，处理完后归还
+var readerPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReaderSize(nil, defaultReadBufferSize)
+	},
+}
+
+func getReader(r io.Reader) *bufio.Reader {
+	br := readerPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putReader(br *bufio.Reader) {
+	br.Reset(nil)
+	readerPool.Put(br)
+}
+
+// writerPool 事件循环模式下发送时借用的写缓冲区，刷新后归还
+var writerPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewWriterSize(nil, defaultWriteBufferSize)
+	},
+}
+
+func getWriter(w io.Writer) *bufio.Writer {
+	bw := writerPool.Get().(*bufio.Writer)
+	bw.Reset(w)
+	return bw
+}
+
+func putWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	writerPool.Put(bw)
+}
+
+// flateWriterPools 按压缩等级划分的压缩器池，不保留压缩上下文时每条消息从池里借用，压缩完归还
+var flateWriterPools [BestCompression - HuffmanOnly + 1]sync.Pool
+
+func getFlateWriter(w io.Writer, level int) (*flate.Writer, error) {
+	if fw, ok := flateWriterPools[level-HuffmanOnly].Get().(*flate.Writer); ok {
+		fw.Reset(w)
+		return fw, nil
+	}
+	return flate.NewWriter(w, level)
+}
+
+func putFlateWriter(fw *flate.Writer, level int) {
+	fw.Reset(nil)
+	flateWriterPools[level-HuffmanOnly].Put(fw)
+}
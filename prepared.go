@@ -0,0 +1,132 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"errors"
+	"sync"
+)
+
+var errPreparedTooBig = errors.New("预编码的消息超过了 SendCriticalSize")
+
+// PreparedMessage 预先编码好的一条text或binary消息，向多个连接发送同一条消息时，
+// 每种连接（服务端或客户端、是否压缩及压缩等级）只压缩一次；服务端的帧不掩码，序列化好的帧字节流也只生成一次。
+// 可以被多个goroutine并发使用
+type PreparedMessage struct {
+	mt      MessageType
+	payload []byte
+
+	mu       sync.Mutex
+	variants map[preparedKey]*preparedVariant
+}
+
+// preparedKey 决定消息编码结果的连接特征
+type preparedKey struct {
+	isServer bool
+	compress bool
+	level    int
+}
+
+// preparedVariant 某种连接下的编码结果
+type preparedVariant struct {
+	payload []byte //编码后的负载
+	rsv     uint16 //消息第一个帧上的rsv位
+	frames  []byte //服务端序列化好的帧，客户端每次发送都要重新掩码，不缓存
+}
+
+// NewPreparedMessage payload 会被复制，调用返回后可以复用
+func NewPreparedMessage(mt MessageType, payload []byte) (*PreparedMessage, error) {
+	if mt != TextFrame && mt != BinaryFrame {
+		return nil, errNotDataMessage
+	}
+	if len(payload) > SendCriticalSize {
+		return nil, errPreparedTooBig
+	}
+	return &PreparedMessage{
+		mt:       mt,
+		payload:  append([]byte(nil), payload...),
+		variants: make(map[preparedKey]*preparedVariant),
+	}, nil
+}
+
+// variant 返回该种连接的编码结果，第一次使用时编码
+func (pm *PreparedMessage) variant(key preparedKey) (*preparedVariant, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if v, ok := pm.variants[key]; ok {
+		return v, nil
+	}
+
+	v := &preparedVariant{payload: pm.payload}
+	if key.compress {
+		p, err := compressNoContext(key.level, pm.payload)
+		if err != nil {
+			return nil, err
+		}
+		v.payload, v.rsv = p, RSV1Bit
+	}
+	if key.isServer {
+		v.frames = encodeMessageFrames(pm.mt, v.payload, v.rsv, true)
+	}
+
+	pm.variants[key] = v
+	return v, nil
+}
+
+// WritePreparedMessage 发送预编码的消息。协商了 permessage-deflate 以外的扩展，
+// 或本端压缩时保留上下文（未协商本端的 no_context_takeover）的连接，不能复用编码结果，按普通消息发送
+func (wc *WsConn) WritePreparedMessage(pm *PreparedMessage) error {
+	key, ok := wc.preparedKey()
+	if !ok {
+		return sendDataFrame(wc, pm.payload, pm.mt)
+	}
+
+	v, err := pm.variant(key)
+	if err != nil {
+		wc.logger.error("c.WritePreparedMessage failed to encode message", "err", err)
+		return err
+	}
+
+	frames := v.frames
+	if !key.isServer {
+		frames = encodeMessageFrames(pm.mt, v.payload, v.rsv, false)
+	}
+	wc.logger.debug("c.send prepared message", "type", pm.mt, "payload", wc.logger.payload(pm.payload))
+	return writePreparedFrames(wc, frames)
+}
+
+// preparedKey 连接适用的编码结果，不能复用时返回false
+func (wc *WsConn) preparedKey() (preparedKey, bool) {
+	key := preparedKey{isServer: wc.IsServer}
+	if wc.extensions == nil {
+		return key, true
+	}
+
+	for _, ec := range wc.extensions.conns {
+		//不保留上下文时，每条消息的压缩结果只取决于压缩等级
+		dc, ok := ec.(*deflateConn)
+		if !ok || !dc.writeNoContextTakeover() {
+			return key, false
+		}
+		key.compress, key.level = true, dc.level
+	}
+	return key, true
+}
+
+// encodeMessageFrames 把一条消息序列化成帧字节流，超过 shardSize 时分片，rsv设置在第一个帧上。
+// 客户端的帧会做掩码处理，不会修改payload
+func encodeMessageFrames(mt MessageType, payload []byte, rsv uint16, isServer bool) []byte {
+	if !isServer {
+		payload = append([]byte(nil), payload...)
+	}
+
+	shards := len(payload)/shardSize + 1
+	b := make([]byte, 0, shards*maxFrameHeaderByteSize+len(payload))
+	_ = shardFrames(mt, payload, rsv, isServer, func(frame *Frame) error {
+		b = append(appendFrameHeader(b, frame), frame.Payload...)
+		return nil
+	})
+	return b
+}
@@ -0,0 +1,117 @@
+package mini_websocket
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// TestEncodeMessageFrames 预编码的帧按 shardSize 分片，对端能读回原消息，且不修改调用方的负载
+func TestEncodeMessageFrames(t *testing.T) {
+	sizes := []int{0, 1, shardSize - 1, shardSize, shardSize + 1, 3*shardSize + 7}
+	for _, n := range sizes {
+		for _, isServer := range []bool{true, false} {
+			t.Run(fmt.Sprintf("len=%d/server=%v", n, isServer), func(t *testing.T) {
+				payload := bytes.Repeat([]byte("p"), n)
+				frames := encodeMessageFrames(BinaryFrame, payload, 0, isServer)
+				if !bytes.Equal(payload, bytes.Repeat([]byte("p"), n)) {
+					t.Fatal("payload modified")
+				}
+
+				//统计帧数：每个分片一个帧
+				want := n/shardSize + 1
+				if n > 0 && n%shardSize == 0 {
+					want--
+				}
+				if got := countFrames(t, frames); got != want {
+					t.Fatalf("frames = %d, want %d", got, want)
+				}
+
+				peer := NewWsConn(&loopConn{data: frames}, !isServer, 0, 0, 0)
+				mt, p, err := peer.ReadMessage()
+				if err != nil || mt != BinaryFrame || !bytes.Equal(p, payload) {
+					t.Fatalf("read back mt=%d len=%d err=%v", mt, len(p), err)
+				}
+			})
+		}
+	}
+}
+
+// TestWritePreparedMessage 同一条预编码消息发给不同种类的连接，每种连接只编码一次，对端都能读到原消息
+func TestWritePreparedMessage(t *testing.T) {
+	payload := bytes.Repeat([]byte("prepared "), shardSize/4)
+	pm, err := NewPreparedMessage(TextFrame, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		compress int
+		noCtx    bool
+		key      *preparedKey //为nil时不能复用编码结果
+	}{
+		{"plain", NoCompression, false, &preparedKey{isServer: true}},
+		{"deflate without context", BestSpeed, true, &preparedKey{isServer: true, compress: true, level: BestSpeed}},
+		{"deflate with context", BestSpeed, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ug := NewUpGrader(0, 0, 0, nil, nil, tt.compress)
+			s := newTestServer(t, &ug, func(c *WsConn, r *http.Request) {
+				for i := 0; i < 2; i++ {
+					if err := c.WritePreparedMessage(pm); err != nil {
+						t.Error(err)
+					}
+				}
+			})
+			d := &Dialer{}
+			if tt.compress != NoCompression {
+				d.Extensions = []Extension{&PermessageDeflate{Level: tt.compress, ServerNoContextTakeover: tt.noCtx}}
+			}
+			c := dialTest(t, s, d)
+			for i := 0; i < 2; i++ {
+				mt, p, err := c.ReadMessage()
+				if err != nil || mt != TextFrame || !bytes.Equal(p, payload) {
+					t.Fatalf("read mt=%v len=%d err=%v", mt, len(p), err)
+				}
+			}
+
+			if tt.key != nil {
+				pm.mu.Lock()
+				_, ok := pm.variants[*tt.key]
+				pm.mu.Unlock()
+				if !ok {
+					t.Fatalf("variant %+v not cached", *tt.key)
+				}
+			}
+		})
+	}
+
+	//客户端的帧每次重新掩码
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		mt, p, err := c.ReadMessage()
+		if err != nil || mt != TextFrame || !bytes.Equal(p, payload) {
+			t.Errorf("server read mt=%v len=%d err=%v", mt, len(p), err)
+		}
+	})
+	if err = dialTest(t, s, nil).WritePreparedMessage(pm); err != nil {
+		t.Fatal(err)
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if len(pm.variants) != 3 {
+		t.Fatalf("variants = %d, want 3", len(pm.variants))
+	}
+}
+
+func TestNewPreparedMessageInvalid(t *testing.T) {
+	if _, err := NewPreparedMessage(PingFrame, nil); err != errNotDataMessage {
+		t.Fatalf("control frame err = %v", err)
+	}
+	if _, err := NewPreparedMessage(BinaryFrame, make([]byte, SendCriticalSize+1)); err != errPreparedTooBig {
+		t.Fatalf("too big err = %v", err)
+	}
+}
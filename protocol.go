@@ -6,9 +6,9 @@ package mini_websocket
 import (
 	"encoding/binary"
 	"errors"
-	"log"
-	"math/rand"
-	"time"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
 )
 
 const (
@@ -16,6 +16,7 @@ const (
 	CloseAsideLeaving     = 1001 // 表示端点正在“离开”，例如服务器关闭或浏览器已离开页面
 	CloseWrongProtocol    = 1002 // 表示端点由于协议错误正在终止连接。
 	CloseNotAccept        = 1003 //关闭连接，因某端点接收到一种它不能接受的数据
+	CloseNoStatus         = 1005 //关闭帧没有携带状态码，不能出现在关闭帧里
 	CloseAbnormal         = 1006 //异常关闭
 	CloseDifferentMsgType = 1007 //表示端点正在终止连接 ，因为它在消息中接收到与消息类型不一致的数据
 	CloseInternalError    = 1008 //根据协议，扩展的错误码，用来指定端内部异常错误，导致关闭
@@ -27,6 +28,7 @@ var closeErrorMap = map[int]string{
 	CloseAsideLeaving:     "服务器关闭或浏览器已离开页面，关闭连接",
 	CloseWrongProtocol:    "协议错误，关闭连接",
 	CloseNotAccept:        "浏览器或服务器接收到不能接受的数据，关闭连接",
+	CloseNoStatus:         "未携带状态码，关闭连接",
 	CloseAbnormal:         "未发送关闭帧，关闭连接",
 	CloseDifferentMsgType: "消息类型不一致，关闭连接",
 	CloseInternalError:    "端点内部错误，关闭连接",
@@ -38,6 +40,57 @@ func Error(code int) string {
 	return closeErrorMap[code]
 }
 
+var (
+	ErrCloseSent    = errors.New("已发送关闭帧，不能再发送数据")
+	errCloseCode    = errors.New("关闭帧的状态码不合法")
+	errCloseReason  = errors.New("关闭帧的原因不能超过123个字节")
+	errClosePayload = errors.New("关闭帧的负载只有1个字节")
+)
+
+// CloseError 对端关闭帧携带的状态码和原因，连接异常断开时状态码为 CloseAbnormal
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	reason := e.Reason
+	if reason == "" {
+		reason = Error(e.Code)
+	}
+	return fmt.Sprintf("websocket连接已关闭: code=%d, reason=%s", e.Code, reason)
+}
+
+// isValidCloseCode 是否为可以出现在关闭帧里的状态码：协议定义的状态码，或者3000~4999
+func isValidCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// parseClosePayload 解析关闭帧的负载：前两个字节为状态码，其余为原因；没有负载时状态码为 CloseNoStatus
+func parseClosePayload(payload []byte) (*CloseError, error) {
+	switch len(payload) {
+	case 0:
+		return &CloseError{Code: CloseNoStatus}, nil
+	case 1:
+		return nil, errClosePayload
+	}
+
+	code := int(binary.BigEndian.Uint16(payload[:2]))
+	if !isValidCloseCode(code) {
+		return nil, errCloseCode
+	}
+	if !utf8.Valid(payload[2:]) {
+		return nil, ErrInvalidUTF8
+	}
+	return &CloseError{Code: code, Reason: string(payload[2:])}, nil
+}
+
 const (
 	minFrameHeaderByteSize = 2 + 4     // header(2 uint8)+MaskingKey(4 uint8 \ 0 uint8)
 	maxFrameHeaderByteSize = 2 + 8 + 4 // header(2 uint8)+payloadExtLen(8 uint8)+MaskingKey(4 uint8)
@@ -92,12 +145,20 @@ var (
 	errFramePayloadLen   = errors.New("frame payload len 值应该为0~125")
 	errFramePayloadLen16 = errors.New("frame payload len 值应该为126")
 	errFramePayloadLen64 = errors.New("frame payload len 值应该为127")
-	//errFrameIsTooBig     = errors.New("frame payload 太大，应该小于或等于 " + strconv.Itoa(maxControlFramePayloadByteSize) + "字节")
+
+	errFrameOpCodeNotAccept = errors.New("frame opcode为不能接受的保留值")
+
+	//读到违反协议的帧时返回以下错误，并以 CloseWrongProtocol 关闭连接
+	ErrControlFrameFragmented = errors.New("控制帧不能分片")
+	ErrControlFrameTooBig     = errors.New("控制帧 payload 太大，应该小于或等于 " + strconv.Itoa(maxControlFramePayloadByteSize) + "字节")
+	ErrFrameNotMasked         = errors.New("客户端发送的帧必须做掩码处理")
+	ErrFrameMasked            = errors.New("服务端发送的帧不能做掩码处理")
+	ErrContinuationNoStart    = errors.New("延续帧之前没有分片消息的开始帧")
+	ErrDataFrameInterleaved   = errors.New("分片消息中出现了新的数据帧")
 )
 
 // CheckFrameWithoutPayload 检验 Frame 格式，以便完成序列化，这里不校验掩码处理的Payload
 func CheckFrameWithoutPayload(frame *Frame) error {
-	log.Println("frame: ", frame)
 	if !(frame.Fin == 1 || frame.Fin == 0) {
 		return errFrameFin
 	}
@@ -117,11 +178,21 @@ func CheckFrameWithoutPayload(frame *Frame) error {
 		return errFrameMask
 	}
 
+	//控制帧不能分片，负载不能超过125字节
+	if isControlOpCode(MessageType(frame.OpCode)) {
+		if frame.Fin == 0 {
+			return ErrControlFrameFragmented
+		}
+		if frame.PayloadLen > maxControlFramePayloadByteSize {
+			return ErrControlFrameTooBig
+		}
+	}
+
 	//if !(frame.Mask == 1 && frame.MaskingKey != 0) {
 	//	return errFrameMaskingKey
 	//}
 
-	if !(frame.PayloadLen > 0 && frame.PayloadLen <= 125) {
+	if !(frame.PayloadLen <= 125) {
 		switch frame.PayloadLen {
 		case 126:
 			if frame.PayloadExtendLen16 == 0 {
@@ -143,8 +214,14 @@ func CheckFrameWithoutPayload(frame *Frame) error {
 // FrameToBytes 将 Frame 中的各个字段，按照websocket协议标准，剔除无关位，并序列化
 // 为字节流数据，此前应该调用 CheckFrameWithoutPayload 检验
 func FrameToBytes(frame *Frame) []byte {
-	buf := make([]byte, 2, minFrameHeaderByteSize+8)
+	buf := appendFrameHeader(make([]byte, 0, maxFrameHeaderByteSize+len(frame.Payload)), frame)
 
+	//追加 payload
+	return append(buf, frame.Payload...)
+}
+
+// appendFrameHeader 把帧头部（负载之前的部分）序列化追加到b后面，b的容量足够时不会分配内存
+func appendFrameHeader(b []byte, frame *Frame) []byte {
 	// 该部分为协议帧里的前16位，即从 Frame.Fin 至 Frame.PayloadLen
 	var part1 uint16
 
@@ -160,32 +237,25 @@ func FrameToBytes(frame *Frame) []byte {
 	part1 |= frame.PayloadLen
 
 	//将 part1 填入字节流的前两个字节，也就是前16位
-	binary.BigEndian.PutUint16(buf[:2], part1)
+	b = append(b, byte(part1>>8), byte(part1))
 
 	switch frame.PayloadLen {
 	case 126:
 		//Payload Len Ext1 启用，长度16bit，扩展16个bit
-		payloadExtendBuf := make([]byte, 2)
-		binary.BigEndian.PutUint16(payloadExtendBuf[:2], frame.PayloadExtendLen16)
-		buf = append(buf, payloadExtendBuf...)
+		b = append(b, byte(frame.PayloadExtendLen16>>8), byte(frame.PayloadExtendLen16))
 	case 127:
 		//Payload Len Ext2 启用，长度64bit，扩展64个bit（显然包括Payload Len Ext1）
-		payloadExtendBuf := make([]byte, 8)
-		binary.BigEndian.PutUint64(payloadExtendBuf[:8], frame.PayloadExtendLen64)
-		buf = append(buf, payloadExtendBuf...)
+		l := frame.PayloadExtendLen64
+		b = append(b, byte(l>>56), byte(l>>48), byte(l>>40), byte(l>>32), byte(l>>24), byte(l>>16), byte(l>>8), byte(l))
 	}
 
 	//当 Frame.Mask==1时，需要设置32位的MaskingKey
 	if frame.Mask == 1 {
-		maskingKeyBuf := make([]byte, 4)
-		binary.BigEndian.PutUint32(maskingKeyBuf[:4], frame.MaskingKey)
-		buf = append(buf, maskingKeyBuf...)
+		k := frame.MaskingKey
+		b = append(b, byte(k>>24), byte(k>>16), byte(k>>8), byte(k))
 	}
 
-	//追加 payload
-	buf = append(buf, frame.Payload...)
-
-	return buf
+	return b
 }
 
 // ParseToFrameHeader 先处理头部帧，只有头部帧是确定长度的，
@@ -195,7 +265,6 @@ func ParseToFrameHeader(frameBytes []byte) *Frame {
 	frame := new(Frame)
 	//header数据
 	part1 := binary.BigEndian.Uint16(frameBytes[:2]) //129 139 | 1000 0001 1000 1011
-	log.Println("header: ", part1)
 	//先与运算，从16位的bit里取出各个字段
 
 	frame.Fin = (part1 & 0x8000) >> 15  // part1 & 1000 0000 0000 0000
@@ -209,10 +278,9 @@ func ParseToFrameHeader(frameBytes []byte) *Frame {
 	return frame
 }
 
-// CreateMaskingKey 随机数生成器随机生成 32 比特的 Masking-Key
+// CreateMaskingKey 随机生成 32 比特的 Masking-Key，RFC 6455 要求掩码不可预测，使用 crypto/rand 生成
 func (f *Frame) CreateMaskingKey() {
-	rand.Seed(time.Now().UnixNano())
-	f.MaskingKey = rand.Uint32()
+	f.MaskingKey = newMaskingKey()
 }
 
 func (f *Frame) MaskPayload() {
@@ -224,17 +292,7 @@ func (f *Frame) MaskPayload() {
 	//masks = append(masks, uint8((f.MaskingKey>>8)&0x00FF))
 	//masks = append(masks, uint8((f.MaskingKey)&0x00FF))
 
-	masks := [4]byte{
-		uint8((f.MaskingKey >> 24) & 0x00FF),
-		uint8((f.MaskingKey >> 16) & 0x00FF),
-		uint8((f.MaskingKey >> 8) & 0x00FF),
-		uint8((f.MaskingKey) & 0x00FF),
-	}
-	//掩码算法
-	for i, v := range f.Payload {
-		j := i % 4
-		f.Payload[i] = v ^ masks[j]
-	}
+	maskBytes(f.MaskingKey, 0, f.Payload)
 }
 
 // CalcPayloadLen 处理frame中的 PayloadLen \ PayloadExtendLen16 \ PayloadExtendLen64
@@ -268,6 +326,19 @@ func (f *Frame) SetPayload(payload []byte) *Frame {
 	return f
 }
 
+// RSV 返回 RSV1、RSV2、RSV3 组合成的rsv位，见 RSV1Bit
+func (f *Frame) RSV() uint16 {
+	return f.RSV1<<2 | f.RSV2<<1 | f.RSV3
+}
+
+// SetRSV 按 RSV1Bit、RSV2Bit、RSV3Bit 组合的rsv位设置 RSV1、RSV2、RSV3
+func (f *Frame) SetRSV(rsv uint16) *Frame {
+	f.RSV1 = (rsv & RSV1Bit) >> 2
+	f.RSV2 = (rsv & RSV2Bit) >> 1
+	f.RSV3 = rsv & RSV3Bit
+	return f
+}
+
 // IsFinal 当协议帧的Fin为1时，表示该帧是结束帧，后续的数据不是连续的
 func (f *Frame) IsFinal() bool {
 	return f.Fin == 1
@@ -0,0 +1,319 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	errTopic   = errors.New("主题不合法：由 '.' 分隔的非空段组成，发布的主题不能包含通配符")
+	errPattern = errors.New("订阅的模式不合法：'*' 匹配一个段，'>' 只能作为最后一段，匹配剩余的一个或多个段")
+)
+
+// PubSubEventType 订阅事件的类型
+type PubSubEventType int
+
+const (
+	PubSubJoin  PubSubEventType = iota //连接订阅了一个模式
+	PubSubLeave                        //连接取消订阅了一个模式，连接关闭时取消它的所有订阅
+)
+
+// PubSubEvent 连接订阅或取消订阅时的事件
+type PubSubEvent struct {
+	Type    PubSubEventType
+	Pattern string
+	Conn    *WsConn
+}
+
+// PubSubBackend 多节点部署时在节点之间转发发布的消息。
+// Publish 的消息需要投递给所有节点（包括发布者自己）通过 Subscribe 注册的处理函数
+type PubSubBackend interface {
+	Publish(topic string, mt MessageType, payload []byte) error
+	Subscribe(handler func(topic string, mt MessageType, payload []byte)) (unsubscribe func(), err error)
+}
+
+// PubSub 基于 Hub 的主题发布订阅。主题由 '.' 分隔成段，如 "orders.created"；
+// 订阅的模式里 '*' 匹配一个段，'>' 作为最后一段时匹配剩余的一个或多个段，如 "orders.*"、"orders.>"。
+// 每个主题保留最近的若干条消息，订阅时按发布顺序补发给新订阅的连接
+type PubSub struct {
+	//订阅事件的回调，在订阅和取消订阅的调用方协程里执行，应在使用前设置
+	OnEvent func(ev PubSubEvent)
+
+	hub         *Hub
+	backend     PubSubBackend
+	unsubscribe func()
+	historySize int
+
+	mu      sync.Mutex
+	seq     uint64
+	subs    map[*WsConn]map[string]bool //连接订阅的模式
+	hooked  map[*WsConn]bool            //已注册关闭回调的连接
+	history map[string][]pubsubRecord   //每个主题最近发布的消息
+}
+
+// pubsubRecord 主题的历史消息，seq 为发布顺序
+type pubsubRecord struct {
+	seq uint64
+	msg *PreparedMessage
+}
+
+// NewPubSub queueSize 为每个连接的发送队列长度，见 NewHub；historySize 为每个主题保留的历史消息条数，为0时不保留；
+// backend 为nil时只在本节点内投递
+func NewPubSub(queueSize, historySize int, backend PubSubBackend) (*PubSub, error) {
+	if historySize < 0 {
+		historySize = 0
+	}
+	ps := &PubSub{
+		hub:         NewHub(queueSize),
+		backend:     backend,
+		historySize: historySize,
+		subs:        make(map[*WsConn]map[string]bool),
+		hooked:      make(map[*WsConn]bool),
+		history:     make(map[string][]pubsubRecord),
+	}
+
+	if backend != nil {
+		unsubscribe, err := backend.Subscribe(ps.deliver)
+		if err != nil {
+			return nil, err
+		}
+		ps.unsubscribe = unsubscribe
+	}
+	return ps, nil
+}
+
+// Close 停止接收 backend 转发的消息
+func (ps *PubSub) Close() {
+	if ps.unsubscribe != nil {
+		ps.unsubscribe()
+	}
+}
+
+// Subscribe 连接订阅一个模式，订阅后补发匹配该模式的主题的历史消息；重复订阅时什么都不做
+func (ps *PubSub) Subscribe(wc *WsConn, pattern string) error {
+	if !validTopic(pattern, true) {
+		return errPattern
+	}
+	ps.mu.Lock()
+	//在锁内加入 Hub，与 Unsubscribe 取消最后一个订阅时移出 Hub 互斥
+	ps.hub.Join(wc)
+	if ps.subs[wc][pattern] {
+		ps.mu.Unlock()
+		return nil
+	}
+	if ps.subs[wc] == nil {
+		ps.subs[wc] = make(map[string]bool)
+	}
+	ps.subs[wc][pattern] = true
+	hook := !ps.hooked[wc]
+	ps.hooked[wc] = true
+
+	//历史消息在锁内入队，保证排在之后发布的消息前面
+	var records []pubsubRecord
+	for topic, rs := range ps.history {
+		if matchTopic(pattern, topic) {
+			records = append(records, rs...)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].seq < records[j].seq })
+	var slow []*WsConn
+	for _, r := range records {
+		slow = append(slow, ps.hub.enqueue(r.msg, []*WsConn{wc})...)
+	}
+	ps.mu.Unlock()
+
+	if hook {
+		wc.onClose(func() { ps.leaveAll(wc) })
+	}
+	ps.hub.dropSlow(slow)
+	ps.emit(PubSubEvent{Type: PubSubJoin, Pattern: pattern, Conn: wc})
+	return nil
+}
+
+// Unsubscribe 连接取消订阅一个模式
+func (ps *PubSub) Unsubscribe(wc *WsConn, pattern string) {
+	ps.mu.Lock()
+	ok := ps.subs[wc][pattern]
+	delete(ps.subs[wc], pattern)
+	//没有订阅的连接移出 Hub，停止它的发送协程
+	if ok && len(ps.subs[wc]) == 0 {
+		delete(ps.subs, wc)
+		ps.hub.Leave(wc)
+	}
+	ps.mu.Unlock()
+
+	if ok {
+		ps.emit(PubSubEvent{Type: PubSubLeave, Pattern: pattern, Conn: wc})
+	}
+}
+
+// leaveAll 连接关闭时取消它的所有订阅
+func (ps *PubSub) leaveAll(wc *WsConn) {
+	ps.mu.Lock()
+	patterns := ps.subs[wc]
+	delete(ps.subs, wc)
+	delete(ps.hooked, wc)
+	ps.mu.Unlock()
+
+	for pattern := range patterns {
+		ps.emit(PubSubEvent{Type: PubSubLeave, Pattern: pattern, Conn: wc})
+	}
+}
+
+// Patterns 连接订阅的所有模式
+func (ps *PubSub) Patterns(wc *WsConn) []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	patterns := make([]string, 0, len(ps.subs[wc]))
+	for pattern := range ps.subs[wc] {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// Members 订阅模式匹配该主题的所有连接
+func (ps *PubSub) Members(topic string) []*WsConn {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.members(topic)
+}
+
+func (ps *PubSub) members(topic string) []*WsConn {
+	var conns []*WsConn
+	for wc, patterns := range ps.subs {
+		for pattern := range patterns {
+			if matchTopic(pattern, topic) {
+				conns = append(conns, wc)
+				break
+			}
+		}
+	}
+	return conns
+}
+
+// Publish 向主题发布一条text或binary消息；设置了 backend 时经由 backend 投递给所有节点
+func (ps *PubSub) Publish(topic string, mt MessageType, payload []byte) error {
+	if !validTopic(topic, false) {
+		return errTopic
+	}
+	if mt != TextFrame && mt != BinaryFrame {
+		return errNotDataMessage
+	}
+	if len(payload) > SendCriticalSize {
+		return errPreparedTooBig
+	}
+
+	if ps.backend != nil {
+		return ps.backend.Publish(topic, mt, payload)
+	}
+	ps.deliver(topic, mt, payload)
+	return nil
+}
+
+// deliver 把消息投递给本节点订阅了该主题的连接，并记入主题的历史消息
+func (ps *PubSub) deliver(topic string, mt MessageType, payload []byte) {
+	msg, err := NewPreparedMessage(mt, payload)
+	if err != nil {
+		return
+	}
+
+	ps.mu.Lock()
+	ps.seq++
+	if ps.historySize > 0 {
+		rs := append(ps.history[topic], pubsubRecord{seq: ps.seq, msg: msg})
+		if len(rs) > ps.historySize {
+			rs = append(rs[:0:0], rs[len(rs)-ps.historySize:]...)
+		}
+		ps.history[topic] = rs
+	}
+
+	var slow []*WsConn
+	if conns := ps.members(topic); len(conns) > 0 {
+		slow = ps.hub.enqueue(msg, conns)
+	}
+	ps.mu.Unlock()
+
+	ps.hub.dropSlow(slow)
+}
+
+func (ps *PubSub) emit(ev PubSubEvent) {
+	if ps.OnEvent != nil {
+		ps.OnEvent(ev)
+	}
+}
+
+// validTopic 校验主题或订阅的模式
+func validTopic(topic string, pattern bool) bool {
+	if topic == "" {
+		return false
+	}
+	segments := strings.Split(topic, ".")
+	for i, seg := range segments {
+		switch {
+		case seg == "":
+			return false
+		case seg == "*" || seg == ">":
+			if !pattern || (seg == ">" && i != len(segments)-1) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchTopic 主题是否匹配订阅的模式
+func matchTopic(pattern, topic string) bool {
+	ps, ts := strings.Split(pattern, "."), strings.Split(topic, ".")
+	for i, p := range ps {
+		if p == ">" {
+			return len(ts) > i
+		}
+		if i >= len(ts) || (p != "*" && p != ts[i]) {
+			return false
+		}
+	}
+	return len(ps) == len(ts)
+}
+
+// LocalBackend 进程内的 PubSubBackend，把消息投递给所有注册的处理函数，
+// 可以让同一进程内的多个 PubSub 模拟多节点部署
+type LocalBackend struct {
+	mu       sync.RWMutex
+	nextID   int
+	handlers map[int]func(topic string, mt MessageType, payload []byte)
+}
+
+func NewLocalBackend() *LocalBackend {
+	return &LocalBackend{handlers: make(map[int]func(string, MessageType, []byte))}
+}
+
+func (lb *LocalBackend) Publish(topic string, mt MessageType, payload []byte) error {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	for _, handler := range lb.handlers {
+		handler(topic, mt, payload)
+	}
+	return nil
+}
+
+func (lb *LocalBackend) Subscribe(handler func(topic string, mt MessageType, payload []byte)) (func(), error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	id := lb.nextID
+	lb.nextID++
+	lb.handlers[id] = handler
+
+	return func() {
+		lb.mu.Lock()
+		delete(lb.handlers, id)
+		lb.mu.Unlock()
+	}, nil
+}
@@ -0,0 +1,133 @@
+package mini_websocket
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newPubSubPair 建立一对连接，返回服务端的连接和客户端的连接
+func newPubSubPair(t *testing.T) (server, client *WsConn) {
+	t.Helper()
+	conns := make(chan *WsConn, 1)
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		conns <- c
+		//读协程处理关闭握手
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	client = dialTest(t, s, nil)
+	return <-conns, client
+}
+
+func readText(t *testing.T, c *WsConn) string {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, p, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(p)
+}
+
+func TestPubSubTopics(t *testing.T) {
+	ps, err := NewPubSub(16, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	wc, client := newPubSubPair(t)
+	_ = ps.Publish("orders.old", TextFrame, []byte("h1"))
+	_ = ps.Publish("orders.old", TextFrame, []byte("h2"))
+	_ = ps.Publish("orders.old", TextFrame, []byte("h3"))
+
+	if err = ps.Subscribe(wc, "orders.*"); err != nil {
+		t.Fatal(err)
+	}
+	//补发最近的两条历史消息
+	for _, want := range []string{"h2", "h3"} {
+		if got := readText(t, client); got != want {
+			t.Fatalf("history = %q, want %q", got, want)
+		}
+	}
+
+	tests := []struct {
+		topic   string
+		matched bool
+	}{
+		{"orders.created", true},
+		{"orders.eu.created", false},
+		{"users.created", false},
+	}
+	for _, tt := range tests {
+		if err = ps.Publish(tt.topic, TextFrame, []byte(tt.topic)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = ps.Publish("orders.done", TextFrame, []byte("end"))
+	for _, tt := range tests {
+		if !tt.matched {
+			continue
+		}
+		if got := readText(t, client); got != tt.topic {
+			t.Fatalf("got %q, want %q", got, tt.topic)
+		}
+	}
+	if got := readText(t, client); got != "end" {
+		t.Fatalf("got %q, want end", got)
+	}
+
+	if err = ps.Subscribe(wc, "orders.>.x"); err == nil {
+		t.Fatal("invalid pattern accepted")
+	}
+	if err = ps.Publish("orders.*", TextFrame, nil); err == nil {
+		t.Fatal("wildcard topic accepted")
+	}
+}
+
+// TestPubSubUnsubscribeLast 取消最后一个订阅后连接移出 Hub，不再保留空的订阅表
+func TestPubSubUnsubscribeLast(t *testing.T) {
+	ps, err := NewPubSub(16, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	wc, client := newPubSubPair(t)
+	_ = ps.Subscribe(wc, "a")
+	_ = ps.Subscribe(wc, "b.>")
+	if ps.hub.Len() != 1 {
+		t.Fatalf("hub len = %d, want 1", ps.hub.Len())
+	}
+
+	ps.Unsubscribe(wc, "a")
+	if ps.hub.Len() != 1 {
+		t.Fatal("conn left the hub while still subscribed")
+	}
+	ps.Unsubscribe(wc, "b.>")
+	if ps.hub.Len() != 0 {
+		t.Fatalf("hub len = %d after last unsubscribe", ps.hub.Len())
+	}
+	ps.mu.Lock()
+	_, ok := ps.subs[wc]
+	ps.mu.Unlock()
+	if ok {
+		t.Fatal("empty subscription map left behind")
+	}
+	if len(ps.Members("b.x")) != 0 {
+		t.Fatal("unsubscribed conn still a member")
+	}
+
+	//重新订阅后可以继续收到消息
+	if err = ps.Subscribe(wc, "a"); err != nil {
+		t.Fatal(err)
+	}
+	_ = ps.Publish("a", TextFrame, []byte("again"))
+	if got := readText(t, client); got != "again" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,274 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+var (
+	errBadEnvelope = errors.New("消息不是合法的信封格式")
+
+	ErrUnauthorized = errors.New("未通过鉴权")
+	ErrRateLimited  = errors.New("消息发送过于频繁")
+)
+
+// HandlerFunc 处理一条消息，返回的错误交给 Router.OnError
+type HandlerFunc func(c *Context) error
+
+// Middleware 包装处理函数，在调用next前后执行额外的逻辑，不调用next即拦截该消息
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Router 按信封里的类型字段把消息分发给注册的处理函数，信封为JSON对象，如 {"type": "chat", "data": {...}}。
+// 同一连接的消息按到达顺序依次处理
+type Router struct {
+	//信封里消息类型和消息数据的字段名，默认为 "type" 和 "data"，应在使用前设置
+	TypeKey, DataKey string
+	//没有注册处理函数的消息类型的处理，为nil时忽略该消息
+	NotFound HandlerFunc
+	//处理函数返回错误或消息不是合法的信封时调用，为nil时记录到连接的日志
+	OnError func(c *Context, err error)
+
+	mu          sync.RWMutex
+	middlewares []Middleware
+	handlers    map[string]HandlerFunc
+}
+
+func NewRouter() *Router {
+	return &Router{
+		TypeKey:  "type",
+		DataKey:  "data",
+		handlers: make(map[string]HandlerFunc),
+	}
+}
+
+// Use 添加作用于所有消息的中间件，按添加顺序由外到内执行
+func (rt *Router) Use(mw ...Middleware) {
+	rt.mu.Lock()
+	rt.middlewares = append(rt.middlewares, mw...)
+	rt.mu.Unlock()
+}
+
+// Handle 注册消息类型的处理函数，mw 为只作用于该类型的中间件，在 Use 添加的中间件之后执行
+func (rt *Router) Handle(typ string, h HandlerFunc, mw ...Middleware) {
+	rt.mu.Lock()
+	rt.handlers[typ] = chain(h, mw)
+	rt.mu.Unlock()
+}
+
+func chain(h HandlerFunc, mw []Middleware) HandlerFunc {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Serve 持续读取连接的消息并分发，直到读取出错，返回读取的错误。
+// header 为握手请求的请求头，可以通过 Context.Header 取得
+func (rt *Router) Serve(wc *WsConn, header http.Header) error {
+	store := &connStore{values: make(map[string]interface{})}
+	for {
+		mt, r, err := wc.NextReader()
+		if err != nil {
+			return err
+		}
+		if mt != TextFrame && mt != BinaryFrame {
+			continue
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		c := &Context{Conn: wc, Header: header, MessageType: mt, router: rt, store: store}
+		rt.dispatch(c, data)
+	}
+}
+
+func (rt *Router) dispatch(c *Context, data []byte) {
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		rt.onError(c, fmt.Errorf("%w: %v", errBadEnvelope, err))
+		return
+	}
+	if err := json.Unmarshal(envelope[rt.TypeKey], &c.Type); err != nil {
+		rt.onError(c, fmt.Errorf("%w: %s字段应为字符串", errBadEnvelope, rt.TypeKey))
+		return
+	}
+	c.Data = envelope[rt.DataKey]
+
+	rt.mu.RLock()
+	h, ok := rt.handlers[c.Type]
+	mw := rt.middlewares
+	rt.mu.RUnlock()
+	if !ok {
+		if rt.NotFound == nil {
+			c.Conn.logger.debug("Router.dispatch no handler for message", "type", c.Type)
+			return
+		}
+		h = rt.NotFound
+	}
+
+	if err := chain(h, mw)(c); err != nil {
+		rt.onError(c, err)
+	}
+}
+
+func (rt *Router) onError(c *Context, err error) {
+	if rt.OnError != nil {
+		rt.OnError(c, err)
+		return
+	}
+	c.Conn.logger.warn("Router failed to handle message", "type", c.Type, "err", err)
+}
+
+// Context 一条消息的处理上下文
+type Context struct {
+	Conn *WsConn
+	//握手请求的请求头
+	Header      http.Header
+	MessageType MessageType
+	//信封里的消息类型
+	Type string
+	//信封里的消息数据，没有该字段时为nil
+	Data json.RawMessage
+
+	router *Router
+	store  *connStore
+}
+
+// connStore 连接的键值存储，同一连接的所有消息共用
+type connStore struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+// Bind 把消息数据以JSON解码到v
+func (c *Context) Bind(v interface{}) error {
+	if len(c.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(c.Data, v)
+}
+
+// Reply 以相同的信封格式向连接发送一条消息
+func (c *Context) Reply(typ string, data interface{}) error {
+	return c.Conn.WriteJSON(map[string]interface{}{c.router.TypeKey: typ, c.router.DataKey: data})
+}
+
+// Set 在连接的键值存储里保存一个值，连接的后续消息都可以取到，可以被多个goroutine并发调用
+func (c *Context) Set(key string, value interface{}) {
+	c.store.mu.Lock()
+	c.store.values[key] = value
+	c.store.mu.Unlock()
+}
+
+// Get 取出连接的键值存储里的值
+func (c *Context) Get(key string) (interface{}, bool) {
+	c.store.mu.RLock()
+	defer c.store.mu.RUnlock()
+	v, ok := c.store.values[key]
+	return v, ok
+}
+
+// Recovery 处理函数panic时恢复，以错误的形式交给 Router.OnError，避免整个读循环退出
+func Recovery() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) (err error) {
+			defer func() {
+				if p := recover(); p != nil {
+					c.Conn.logger.error("Recovery handler panicked", "type", c.Type, "panic", p, "stack", string(debug.Stack()))
+					err = fmt.Errorf("处理函数panic: %v", p)
+				}
+			}()
+			return next(c)
+		}
+	}
+}
+
+// Logging 把每条消息的类型、处理耗时和错误以info等级记录到连接的日志
+func Logging() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			start := time.Now()
+			err := next(c)
+			c.Conn.logger.log(LevelInfo, "Router handled message", "type", c.Type, "elapsed", time.Since(start), "err", err)
+			return err
+		}
+	}
+}
+
+// Auth check 返回false时拦截消息，返回 ErrUnauthorized；
+// 通常根据 Context.Header 或 Context.Get 里保存的登录信息判断
+func Auth(check func(c *Context) bool) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			if !check(c) {
+				return ErrUnauthorized
+			}
+			return next(c)
+		}
+	}
+}
+
+// RateLimit 按连接限制消息的处理速率，每个连接每秒补充rate个令牌，最多积攒burst个，
+// 令牌不足时拦截消息，返回 ErrRateLimited
+func RateLimit(rate float64, burst int) Middleware {
+	var mu sync.Mutex
+	buckets := make(map[*WsConn]*tokenBucket)
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			mu.Lock()
+			b, ok := buckets[c.Conn]
+			if !ok {
+				b = &tokenBucket{tokens: float64(burst), last: time.Now()}
+				buckets[c.Conn] = b
+			}
+			allow := b.take(rate, burst)
+			mu.Unlock()
+
+			if !ok {
+				wc := c.Conn
+				wc.onClose(func() {
+					mu.Lock()
+					delete(buckets, wc)
+					mu.Unlock()
+				})
+			}
+			if !allow {
+				return ErrRateLimited
+			}
+			return next(c)
+		}
+	}
+}
+
+// tokenBucket 令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(rate float64, burst int) bool {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
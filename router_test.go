@@ -0,0 +1,126 @@
+package mini_websocket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRouter 信封按类型分发，中间件鉴权、限流和恢复panic，错误交给 OnError，同一连接的消息共用键值存储
+func TestRouter(t *testing.T) {
+	rt := NewRouter()
+	rt.Use(Recovery(), Logging())
+	rt.NotFound = func(c *Context) error { return c.Reply("unknown", c.Type) }
+	rt.OnError = func(c *Context, err error) { _ = c.Reply("error", err.Error()) }
+
+	rt.Handle("login", func(c *Context) error {
+		var p struct{ Name string }
+		if err := c.Bind(&p); err != nil {
+			return err
+		}
+		c.Set("user", p.Name)
+		return c.Reply("welcome", p.Name)
+	})
+	loggedIn := Auth(func(c *Context) bool {
+		_, ok := c.Get("user")
+		return ok
+	})
+	rt.Handle("whoami", func(c *Context) error {
+		user, _ := c.Get("user")
+		return c.Reply("user", user)
+	}, loggedIn)
+	rt.Handle("echo", func(c *Context) error { return c.Reply("echo", c.Data) })
+	rt.Handle("header", func(c *Context) error { return c.Reply("header", c.Header.Get("X-Token")) })
+	rt.Handle("panic", func(c *Context) error { panic("oops") })
+	rt.Handle("limited", func(c *Context) error { return c.Reply("ok", nil) }, RateLimit(0.001, 2))
+
+	s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+		_ = rt.Serve(c, r.Header)
+	})
+	c, err := DefaultDialer.Dial(context.Background(), wsURL(s), http.Header{"X-Token": {"t1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTcp(c)
+
+	tests := []struct {
+		name     string
+		msg      string
+		wantType string
+		wantData string
+	}{
+		{"auth rejected", `{"type":"whoami"}`, "error", ErrUnauthorized.Error()},
+		{"login", `{"type":"login","data":{"name":"ann"}}`, "welcome", "ann"},
+		{"auth passed", `{"type":"whoami"}`, "user", "ann"},
+		{"echo", `{"type":"echo","data":{"k":[1,2]}}`, "echo", `{"k":[1,2]}`},
+		{"header", `{"type":"header"}`, "header", "t1"},
+		{"panic recovered", `{"type":"panic"}`, "error", "oops"},
+		{"bad envelope", `not json`, "error", errBadEnvelope.Error()},
+		{"type not a string", `{"type":1}`, "error", errBadEnvelope.Error()},
+		{"not found", `{"type":"nope"}`, "unknown", "nope"},
+		{"rate limit 1", `{"type":"limited"}`, "ok", ""},
+		{"rate limit 2", `{"type":"limited"}`, "ok", ""},
+		{"rate limited", `{"type":"limited"}`, "error", ErrRateLimited.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.SendMessage(tt.msg); err != nil {
+				t.Fatal(err)
+			}
+			_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var reply struct {
+				Type string
+				Data json.RawMessage
+			}
+			if err := c.ReadJSON(&reply); err != nil {
+				t.Fatal(err)
+			}
+			data := string(reply.Data)
+			if s, err := jsonString(reply.Data); err == nil {
+				data = s
+			}
+			if reply.Type != tt.wantType || !strings.Contains(data, tt.wantData) {
+				t.Fatalf("reply %s %s, want %s containing %q", reply.Type, reply.Data, tt.wantType, tt.wantData)
+			}
+		})
+	}
+}
+
+// jsonString JSON字符串解码为字符串
+func jsonString(data json.RawMessage) (string, error) {
+	var s string
+	err := json.Unmarshal(data, &s)
+	return s, err
+}
+
+// TestRouterMiddlewareOrder Use 添加的中间件按添加顺序由外到内执行，之后是 Handle 的中间件
+func TestRouterMiddlewareOrder(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(c *Context) error {
+				order = append(order, name)
+				return next(c)
+			}
+		}
+	}
+
+	rt := NewRouter()
+	rt.TypeKey, rt.DataKey = "kind", "body"
+	rt.Use(mark("a"), mark("b"))
+	rt.Handle("m", func(c *Context) error {
+		var body string
+		_ = c.Bind(&body)
+		order = append(order, "handler:"+body)
+		return nil
+	}, mark("c"))
+
+	c := &Context{Conn: NewWsConn(&writeConn{}, true, 0, 0, 0), router: rt, store: &connStore{values: map[string]interface{}{}}}
+	rt.dispatch(c, []byte(`{"kind":"m","body":"x"}`))
+	if got := strings.Join(order, ","); got != "a,b,c,handler:x" {
+		t.Fatalf("order = %s", got)
+	}
+}
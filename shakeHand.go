@@ -4,10 +4,11 @@
 package mini_websocket
 
 import (
+	"bufio"
 	"compress/flate"
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"time"
 )
@@ -16,6 +17,8 @@ const (
 	minHandshakeTimeout = time.Second //握手最少超时时间
 )
 
+var ErrHandshakeTimeout = errors.New("websocket握手超时")
+
 //压缩等级
 const (
 	NoCompression      = flate.NoCompression
@@ -27,27 +30,52 @@ const (
 
 var DefaultUpGrader = upGrader{
 	HandshakeTimeout: minHandshakeTimeout,
-	ReadBufferSize:   minReadBufferSize,
-	WriteBufferSize:  minWriteBufferSize,
+	ReadBufferSize:   defaultReadBufferSize,
+	WriteBufferSize:  defaultWriteBufferSize,
 	OnError:          defaultOnErr,
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 	CompressLevel: 0,
+	ReadLimit:     defaultReadLimit,
 }
 
 // UpGrader 指定将http连接劫持升级为websocket连接
 type upGrader struct {
 	//握手超时时间
 	HandshakeTimeout time.Duration
-	//指定底层网络连接的缓冲区大小
+	//指定底层网络连接的缓冲区大小，为0时使用默认的65535字节，最少256字节
 	ReadBufferSize, WriteBufferSize int
+	//写缓冲池，不为nil时连接只在发送时从池里借用写缓冲区，适合大量连接
+	WriteBufferPool BufferPool
 	//错误的处理函数
 	OnError func(w http.ResponseWriter, status int, reason string)
 	//跨域支持
 	CheckOrigin func(r *http.Request) bool
-	//压缩等级
+	//压缩等级，不为 NoCompression 时启用 permessage-deflate 扩展
 	CompressLevel int
+	//压缩时跨消息保留压缩上下文，重复内容多的消息压缩率更高，但每个连接常驻一个压缩器
+	//（BestSpeed约486KB，DefaultCompression约748KB，BestCompression约1MB），预编码的广播也只能逐个连接重新压缩；
+	//默认响应 server_no_context_takeover，压缩器只在发送时从池里借用
+	CompressContextTakeover bool
+	//支持的扩展，按注册顺序与客户端请求的扩展协商
+	Extensions []Extension
+	//支持的子协议，按客户端请求的顺序选出第一个支持的子协议
+	Subprotocols []string
+	//自定义子协议的选择，不为nil时优先于 Subprotocols，返回空串表示不使用子协议
+	SelectSubprotocol func(r *http.Request, offered []string) string
+	//子协议对应的编解码器，协商出的子协议在其中时设置为连接的编解码器，见 WsConn.SetCodec
+	Codecs map[string]Codec
+	//单条消息的最大字节数，为0时不限制，可以通过 WsConn.SetReadLimit 修改
+	ReadLimit int64
+	//连接的日志，为nil时不输出日志
+	Logger Logger
+	//debug日志里不输出消息负载，只输出负载长度
+	RedactPayload bool
+	//发送ping帧的间隔，为0时不开启保活，见 WsConn.StartKeepalive
+	PingInterval time.Duration
+	//等待pong帧的最长时间，为0时使用 PingInterval 的两倍
+	PongWait time.Duration
 }
 
 // NewUpGrader 如果为提供 OnError 参数，将默认使用默认错误处理逻辑
@@ -61,12 +89,8 @@ func NewUpGrader(handshakeTimeout time.Duration, RBufSize, WBufSize int, OnErr f
 	if handshakeTimeout < minHandshakeTimeout {
 		handshakeTimeout = minHandshakeTimeout
 	}
-	if RBufSize < minReadBufferSize || RBufSize > maxReadBufferSize {
-		RBufSize = minReadBufferSize
-	}
-	if WBufSize < minWriteBufferSize || WBufSize > maxWriteBufferSize {
-		WBufSize = minWriteBufferSize
-	}
+	RBufSize = bufferSize(RBufSize, defaultReadBufferSize, minReadBufferSize, maxReadBufferSize)
+	WBufSize = bufferSize(WBufSize, defaultWriteBufferSize, minWriteBufferSize, maxWriteBufferSize)
 
 	if compressLevel < HuffmanOnly || compressLevel > BestCompression {
 		compressLevel = NoCompression //默认无压缩
@@ -78,6 +102,7 @@ func NewUpGrader(handshakeTimeout time.Duration, RBufSize, WBufSize int, OnErr f
 		OnError:          OnErr,
 		CheckOrigin:      checkOrigin,
 		CompressLevel:    compressLevel,
+		ReadLimit:        defaultReadLimit,
 	}
 }
 
@@ -86,10 +111,7 @@ func defaultOnErr(w http.ResponseWriter, status int, reason string) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(status)
 
-	if _, err := fmt.Fprintln(w, http.StatusText(status), "\taside reason: ", reason); err != nil {
-		log.Println("defaultOnError wrong: ", err)
-		return
-	}
+	_, _ = fmt.Fprintln(w, http.StatusText(status), "\taside reason: ", reason)
 }
 
 // defaultCheckOrigin 默认检查跨域
@@ -114,7 +136,45 @@ func (ug *upGrader) Error(w http.ResponseWriter, status int, reason string) (*Ws
 	return nil, err
 }
 
+// extensions 注册的扩展，压缩等级不为 NoCompression 时优先协商 permessage-deflate
+func (ug *upGrader) extensions() []Extension {
+	if ug.CompressLevel == NoCompression {
+		return ug.Extensions
+	}
+	pd := NewPermessageDeflate(ug.CompressLevel)
+	pd.ServerNoContextTakeover = !ug.CompressContextTakeover
+	return append([]Extension{pd}, ug.Extensions...)
+}
+
+// selectSubprotocol 从客户端请求的 Sec-WebSocket-Protocol 里选出子协议，没有支持的子协议时返回空串
+func (ug *upGrader) selectSubprotocol(r *http.Request) string {
+	offered := headerTokens(r.Header, "Sec-WebSocket-Protocol")
+	if len(offered) == 0 {
+		return ""
+	}
+
+	if ug.SelectSubprotocol != nil {
+		//只能选择客户端请求过的子协议
+		if selected := ug.SelectSubprotocol(r, offered); containsString(offered, selected) {
+			return selected
+		}
+		return ""
+	}
+
+	for _, p := range offered {
+		if containsString(ug.Subprotocols, p) {
+			return p
+		}
+	}
+	return ""
+}
+
 func (ug *upGrader) UpGrade(r *http.Request, w http.ResponseWriter) (conn *WsConn, err error) {
+	return ug.UpGradeContext(context.Background(), r, w)
+}
+
+// UpGradeContext 同 UpGrade，ctx结束时中断101响应的写入并返回 ctx.Err()，握手完成后ctx不再影响返回的连接
+func (ug *upGrader) UpGradeContext(ctx context.Context, r *http.Request, w http.ResponseWriter) (conn *WsConn, err error) {
 	//开始握手
 	start := time.Now()
 	//校验http请求的头部字段，确定是否为握手请求
@@ -146,6 +206,11 @@ func (ug *upGrader) UpGrade(r *http.Request, w http.ResponseWriter) (conn *WsCon
 		return ug.Error(w, http.StatusBadRequest, "请求头应包含Sec-WebSocket-Key字段的24位随机字符串,wrong: "+SWK)
 	}
 
+	if err = ctx.Err(); err != nil {
+		ug.OnError(w, http.StatusServiceUnavailable, "握手已取消")
+		return nil, err
+	}
+
 	//若为握手请求，将劫持http服务器持有的连接塞到websocket里
 	h, ok := w.(http.Hijacker)
 	if !ok {
@@ -157,26 +222,58 @@ func (ug *upGrader) UpGrade(r *http.Request, w http.ResponseWriter) (conn *WsCon
 		return ug.Error(w, http.StatusInternalServerError, "不能劫持http请求")
 	}
 
+	//协商扩展和子协议
+	negotiated, extensions := acceptExtensions(parseExtensions(r.Header), ug.extensions())
+	subprotocol := ug.selectSubprotocol(r)
+
 	//拼接响应数据
 	_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
 	_, _ = brw.WriteString("Connection:upgrade\r\n")
 	_, _ = brw.WriteString("Upgrade:websocket\r\n")
-	_, _ = brw.WriteString("Sec-WebSocket-Accept:" + EncodeSWK(SWK) + "\r\n\r\n")
+	_, _ = brw.WriteString("Sec-WebSocket-Accept:" + EncodeSWK(SWK) + "\r\n")
+	if extensions != "" {
+		_, _ = brw.WriteString("Sec-WebSocket-Extensions:" + extensions + "\r\n")
+	}
+	if subprotocol != "" {
+		_, _ = brw.WriteString("Sec-WebSocket-Protocol:" + subprotocol + "\r\n")
+	}
+	_, _ = brw.WriteString("\r\n")
 
-	if err = brw.Flush(); err != nil {
+	//握手超时限制101响应的写入，超时的连接还没有完成升级，直接关闭，不发送关闭帧
+	if ug.HandshakeTimeout > 0 {
+		_ = netConn.SetWriteDeadline(start.Add(ug.HandshakeTimeout))
+	}
+	stop := watchContext(ctx, netConn.SetWriteDeadline)
+	err = brw.Flush()
+	if stop() && err != nil {
+		err = ctx.Err()
+	} else if isTimeout(err) {
+		err = ErrHandshakeTimeout
+	}
+	if err != nil {
 		_ = netConn.Close()
-		log.Printf("Upgrader.Upgrade could not write response, err=%v", err)
+		logTo(ug.Logger, LevelWarn, "Upgrader.Upgrade could not write response", "remote", netConn.RemoteAddr(), "err", err)
 		return nil, err
 	}
+	//握手完成，清除底层连接上的超时时间
+	_ = netConn.SetDeadline(time.Time{})
 
-	//建立连接
-	wsConn := NewWsConn(netConn, true, ug.ReadBufferSize, ug.WriteBufferSize, ug.CompressLevel)
-
-	//握手超时处理
-	if start.Add(ug.HandshakeTimeout).Before(time.Now()) {
-		err = wsConn.CloseAbnormal()
-		return nil, err
+	//客户端可能在收到101响应前就发来了帧，这些数据已经在劫持的读缓冲区里，复用该缓冲区避免丢失；
+	//否则第一次读取时再按 ReadBufferSize 分配
+	var br *bufio.Reader
+	if brw.Reader.Buffered() > 0 {
+		br = brw.Reader
 	}
 
+	//建立连接
+	wsConn := newWsConn(netConn, true, br, ug.ReadBufferSize, ug.WriteBufferSize, ug.CompressLevel)
+	wsConn.writePool = ug.WriteBufferPool
+	wsConn.extensions = negotiated
+	wsConn.subprotocol = subprotocol
+	wsConn.SetCodec(ug.Codecs[subprotocol])
+	wsConn.SetReadLimit(ug.ReadLimit)
+	wsConn.SetLogger(ug.Logger, ug.RedactPayload)
+	wsConn.StartKeepalive(ug.PingInterval, ug.PongWait)
+
 	return wsConn, nil
 }
@@ -0,0 +1,70 @@
+package mini_websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestSubprotocolSelection(t *testing.T) {
+	pickLast := func(r *http.Request, offered []string) string { return offered[len(offered)-1] }
+	tests := []struct {
+		name      string
+		supported []string
+		selectFn  func(r *http.Request, offered []string) string
+		offered   []string
+		want      string
+	}{
+		{"client order", []string{"chat", "json"}, nil, []string{"json", "chat"}, "json"},
+		{"first supported", []string{"chat"}, nil, []string{"json", "chat"}, "chat"},
+		{"none supported", []string{"chat"}, nil, []string{"json"}, ""},
+		{"none offered", []string{"chat"}, nil, nil, ""},
+		{"custom select", []string{"chat"}, pickLast, []string{"chat", "json"}, "json"},
+		{"custom select unoffered", nil, func(*http.Request, []string) string { return "xml" }, []string{"json"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ug := DefaultUpGrader
+			ug.Subprotocols = tt.supported
+			ug.SelectSubprotocol = tt.selectFn
+			got := make(chan string, 1)
+			s := newTestServer(t, &ug, func(c *WsConn, r *http.Request) {
+				got <- c.Subprotocol()
+			})
+
+			c := dialTest(t, s, &Dialer{Subprotocols: tt.offered})
+			if c.Subprotocol() != tt.want {
+				t.Fatalf("client subprotocol = %q, want %q", c.Subprotocol(), tt.want)
+			}
+			if p := <-got; p != tt.want {
+				t.Fatalf("server subprotocol = %q, want %q", p, tt.want)
+			}
+		})
+	}
+}
+
+// TestSubprotocolRejection 服务端响应了未请求的子协议或者多个子协议时，客户端握手失败
+func TestSubprotocolRejection(t *testing.T) {
+	tests := []struct {
+		name     string
+		offered  []string
+		protocol string
+	}{
+		{"unrequested", []string{"chat"}, "json"},
+		{"not offered any", nil, "chat"},
+		{"several", []string{"chat", "json"}, "chat, json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := newRawHandshakeServer(t, func(key string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+					"Sec-WebSocket-Accept: " + EncodeSWK(key) + "\r\nSec-WebSocket-Protocol: " + tt.protocol + "\r\n\r\n"
+			})
+			d := &Dialer{Subprotocols: tt.offered}
+			if _, err := d.Dial(context.Background(), url, nil); !errors.Is(err, ErrBadHandshake) {
+				t.Fatalf("err = %v, want ErrBadHandshake", err)
+			}
+		})
+	}
+}
@@ -6,10 +6,14 @@ package mini_websocket
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
+	"errors"
 	"io"
+	"net"
 	"net/http"
+	"strings"
 )
 
 const GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11" //magic string
@@ -26,10 +30,79 @@ func IsWsHeader(header http.Header, expectK, expectV string) bool {
 	return false
 }
 
+// HeaderContainsToken 检查header里以逗号分隔的值是否包含token，忽略大小写
+func HeaderContainsToken(header http.Header, key, token string) bool {
+	for _, t := range headerTokens(header, key) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerTokens 按顺序取出header里以逗号分隔的所有值
+func headerTokens(header http.Header, key string) []string {
+	var tokens []string
+	for _, v := range header[http.CanonicalHeaderKey(key)] {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	return tokens
+}
+
+// extensionOffer Sec-WebSocket-Extensions 里的一项扩展及其参数
+type extensionOffer struct {
+	name   string
+	params map[string]string
+}
+
+// parseExtensions 解析header里的 Sec-WebSocket-Extensions 字段，
+// 格式为 "ext1; k1=v1; k2, ext2"，参数值两侧的引号会被去掉
+func parseExtensions(header http.Header) []extensionOffer {
+	var offers []extensionOffer
+	for _, v := range header[http.CanonicalHeaderKey("Sec-WebSocket-Extensions")] {
+		for _, ext := range strings.Split(v, ",") {
+			parts := strings.Split(ext, ";")
+			name := strings.ToLower(strings.TrimSpace(parts[0]))
+			if name == "" {
+				continue
+			}
+
+			offer := extensionOffer{name: name, params: make(map[string]string)}
+			for _, param := range parts[1:] {
+				kv := strings.SplitN(param, "=", 2)
+				k := strings.ToLower(strings.TrimSpace(kv[0]))
+				if k == "" {
+					continue
+				}
+				val := ""
+				if len(kv) == 2 {
+					val = strings.Trim(strings.TrimSpace(kv[1]), "\"")
+				}
+				offer.params[k] = val
+			}
+			offers = append(offers, offer)
+		}
+	}
+	return offers
+}
+
 func IsSWK(str string) bool {
 	return len(str) == 24
 }
 
+// GenerateSWK 生成客户端握手用的Sec-WebSocket-Key：16字节随机数的base64编码
+func GenerateSWK() string {
+	p := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, p); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(p)
+}
+
 // EncodeSWK 将客户端的Sec-WebSocket-Key和 GUID
 // 编码成SHA-1哈希值，并返回哈希的base64编码
 func EncodeSWK(swk string) string {
@@ -71,3 +144,18 @@ func UGZipBytes(data []byte) []byte {
 
 	return out.Bytes()
 }
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isTimeout 是否为网络读写超时的错误
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
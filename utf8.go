@@ -0,0 +1,75 @@
+// @author cold bin
+// @date 2026/10/16
+
+package mini_websocket
+
+import (
+	"errors"
+	"io"
+	"unicode/utf8"
+)
+
+var ErrInvalidUTF8 = errors.New("text消息或关闭帧的原因不是合法的utf-8编码")
+
+// utf8Validator 增量校验utf-8编码，跨越分片或多次读取的多字节字符会被缓存到下一次校验
+type utf8Validator struct {
+	pending [utf8.UTFMax]byte //上一段数据末尾不完整的字符
+	n       int
+}
+
+// validate 校验紧接着上一段数据的p
+func (v *utf8Validator) validate(p []byte) bool {
+	//先补全上一段末尾不完整的字符
+	for v.n > 0 && len(p) > 0 {
+		v.pending[v.n] = p[0]
+		v.n++
+		p = p[1:]
+		if utf8.FullRune(v.pending[:v.n]) {
+			if r, size := utf8.DecodeRune(v.pending[:v.n]); r == utf8.RuneError && size == 1 {
+				return false
+			}
+			v.n = 0
+		}
+	}
+
+	//末尾不完整的字符留到下一段再校验
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				v.n = copy(v.pending[:], p[i:])
+				p = p[:i]
+			}
+			break
+		}
+	}
+
+	return utf8.Valid(p)
+}
+
+// complete 数据结束时不能有不完整的字符
+func (v *utf8Validator) complete() bool {
+	return v.n == 0
+}
+
+// textReader 边读边校验text消息的utf-8编码，不合法时以 CloseDifferentMsgType 关闭连接
+type textReader struct {
+	wc  *WsConn
+	r   io.Reader
+	v   utf8Validator
+	err error
+}
+
+func (tr *textReader) Read(p []byte) (int, error) {
+	if tr.err != nil {
+		return 0, tr.err
+	}
+
+	n, err := tr.r.Read(p)
+	if !tr.v.validate(p[:n]) || (err == io.EOF && !tr.v.complete()) {
+		tr.wc.logger.warn("Conn.NextReader got invalid utf-8 text message")
+		_ = tr.wc.CloseDifferentMsgType()
+		tr.err = ErrInvalidUTF8
+		return 0, tr.err
+	}
+	return n, err
+}
@@ -0,0 +1,99 @@
+package mini_websocket
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// TestUTF8ValidatorSplit 在任意位置切开的合法utf-8都能通过校验，不合法的编码在某一段或结束时被发现
+func TestUTF8ValidatorSplit(t *testing.T) {
+	tests := []struct {
+		name  string
+		s     string
+		valid bool
+	}{
+		{"ascii", "hello", true},
+		{"two bytes", "héllo", true},
+		{"three bytes", "a€b€", true},
+		{"four bytes", "𝄞x𝄞", true},
+		{"mixed", "κόσμε€𝄞", true},
+		{"invalid byte", "ab\xffcd", false},
+		{"overlong", "a\xc0\xafb", false},
+		{"surrogate", "a\xed\xa0\x80b", false},
+		{"truncated at end", "ab\xe2\x82", false},
+		{"continuation only", "\x80", false},
+		{"too large", "\xf4\x90\x80\x80", false},
+	}
+	for _, tt := range tests {
+		for i := 0; i <= len(tt.s); i++ {
+			for j := i; j <= len(tt.s); j++ {
+				t.Run(fmt.Sprintf("%s/%d/%d", tt.name, i, j), func(t *testing.T) {
+					var v utf8Validator
+					ok := v.validate([]byte(tt.s[:i])) && v.validate([]byte(tt.s[i:j])) &&
+						v.validate([]byte(tt.s[j:])) && v.complete()
+					if ok != tt.valid {
+						t.Fatalf("valid = %v, want %v", ok, tt.valid)
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestTextMessageUTF8 多字节字符可以跨越分片，不合法的text消息和关闭原因以1007关闭
+func TestTextMessageUTF8(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		want   string
+		err    error
+	}{
+		{"rune split across fragments", [][]byte{
+			rawFrame(TextFrame, false, 0, true, []byte("a\xe2")),
+			rawFrame(ContinuationFrame, false, 0, true, []byte("\x82")),
+			rawFrame(PingFrame, true, 0, true, nil),
+			rawFrame(ContinuationFrame, true, 0, true, []byte("\xac\xf0\x9d\x84\x9e")),
+		}, "a€𝄞", nil},
+		{"invalid in fragment", [][]byte{
+			rawFrame(TextFrame, false, 0, true, []byte("ok")),
+			rawFrame(ContinuationFrame, true, 0, true, []byte("\xff")),
+		}, "", ErrInvalidUTF8},
+		{"truncated at end", [][]byte{
+			rawFrame(TextFrame, false, 0, true, []byte("a")),
+			rawFrame(ContinuationFrame, true, 0, true, []byte("\xe2\x82")),
+		}, "", ErrInvalidUTF8},
+		{"binary is not checked", [][]byte{rawFrame(BinaryFrame, true, 0, true, []byte("\xff"))}, "\xff", nil},
+		{"close reason", [][]byte{rawFrame(ConnectionCloseFrame, true, 0, true, []byte("\x03\xe8\xff"))}, "", ErrInvalidUTF8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			type result struct {
+				p   []byte
+				err error
+			}
+			res := make(chan result, 1)
+			s := newTestServer(t, nil, func(c *WsConn, r *http.Request) {
+				_, p, err := c.ReadMessage()
+				res <- result{p, err}
+			})
+			c := dialTest(t, s, nil)
+			for _, f := range tt.frames {
+				writeRaw(t, c, f)
+			}
+
+			got := <-res
+			if tt.err != nil {
+				if !errors.Is(got.err, tt.err) {
+					t.Fatalf("server err = %v, want %v", got.err, tt.err)
+				}
+				expectCloseCode(t, c, CloseDifferentMsgType)
+				return
+			}
+			if got.err != nil || string(got.p) != tt.want {
+				t.Fatalf("got %q, %v, want %q", got.p, got.err, tt.want)
+			}
+		})
+	}
+}